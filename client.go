@@ -1,12 +1,16 @@
 package godtp
 
 import (
-	"crypto/rsa"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ClientEventType defines the type of client event
@@ -16,19 +20,43 @@ type ClientEventType uint
 const (
 	ClientReceive ClientEventType = iota
 	ClientDisconnected
+	ClientStream
+	ClientFileOffer
+	ClientFileProgress
+	ClientFileComplete
+	ClientError
 )
 
 // ClientEvent defines an event emitted from the client
 type ClientEvent[T any] struct {
-	EventType ClientEventType
-	Data      T
+	EventType  ClientEventType
+	Data       T
+	Unreliable bool
+	Stream     *Stream
+	File       *FileTransfer
+	Err        error
+	Headers    Headers
 }
 
 // Client defines the socket client type
 type Client[S any, R any] struct {
-	connected    bool
+	connected    atomic.Bool
 	sock         net.Conn
+	datagramSock *net.UDPConn
 	key          []byte
+	settings     protocolSettings
+	datagram     *datagramSession
+	streams      *streamMux
+	writeMutex   fairMutex
+	config       protocolConfig
+	router       *Router[R]
+	validation   ValidationPolicy
+	validate     func(data R) error
+	inbound      interceptorChain[R]
+	outbound     interceptorChain[S]
+	metrics      metrics
+	logger       *slog.Logger
+	log          *slog.Logger
 	eventChannel chan<- ClientEvent[R]
 	wg           sync.WaitGroup
 }
@@ -38,14 +66,25 @@ func NewClient[S any, R any]() (*Client[S, R], <-chan ClientEvent[R]) {
 	eventChannel := make(chan ClientEvent[R], channelBufferSize)
 
 	return &Client[S, R]{
-		connected:    false,
+		writeMutex:   newFairMutex(),
+		config:       newProtocolConfig(),
+		logger:       discardLogger,
+		log:          discardLogger,
 		eventChannel: eventChannel,
 	}, eventChannel
 }
 
+// NewRawClient creates a new client that sends and receives byte slices as-is, without encoding them. The JSON codec
+// is used instead if the server does not support raw messages.
+func NewRawClient() (*Client[[]byte, []byte], <-chan ClientEvent[[]byte]) {
+	client, eventChannel := NewClient[[]byte, []byte]()
+	client.config.codecs = []Codec{CodecRaw, CodecJSON}
+	return client, eventChannel
+}
+
 // Connect to a server
 func (client *Client[S, R]) Connect(host string, port uint16) error {
-	if client.connected {
+	if client.connected.Load() {
 		return fmt.Errorf("client is already connected to a server")
 	}
 
@@ -54,32 +93,112 @@ func (client *Client[S, R]) Connect(host string, port uint16) error {
 	if err != nil {
 		return err
 	}
+
+	return client.ConnectConn(conn)
+}
+
+// ConnectConn connects to a server over an existing connection, such as an in-memory or wrapped connection. The
+// connection is closed if the key exchange fails, and when the client disconnects. Unreliable messages require a TCP
+// connection.
+func (client *Client[S, R]) ConnectConn(conn net.Conn) error {
+	if client.connected.Load() {
+		return fmt.Errorf("client is already connected to a server")
+	}
+
+	start := time.Now()
 	client.sock = conn
-	client.connected = true
+	client.connected.Store(true)
+	client.log = client.logger.With(slog.Any("remote_addr", conn.RemoteAddr()))
 
-	err = client.exchangeKeys()
+	err := client.exchangeKeys()
 	if err != nil {
+		client.metrics.handshakesFailed.Add(1)
+		client.log.Warn("handshake failed", slog.Any("error", err))
+		client.connected.Store(false)
+		client.sock.Close()
 		return err
 	}
+	client.metrics.handshakeLatency.observe(time.Since(start))
+
+	client.streams = newStreamMux(true, client.config.maxStreams, client.writeFrame, func(stream *Stream) {
+		if stream.kind == streamFile {
+			hooks := client.transferHooks()
+			hooks.spawn(func() {
+				receiveFileOffer(stream, hooks)
+			})
+			return
+		}
+
+		client.eventChannel <- ClientEvent[R]{
+			EventType: ClientStream,
+			Stream:    stream,
+		}
+	})
+
+	if client.config.unreliable {
+		err = client.connectDatagrams()
+		if err != nil {
+			client.log.Warn("failed to open datagram channel", slog.Any("error", err))
+			client.connected.Store(false)
+			client.sock.Close()
+			return err
+		}
+	}
 
 	client.wg.Add(1)
 	go client.handle()
+	client.log.Info("connected to server",
+		slog.Uint64("version", uint64(client.settings.version)),
+		slog.String("codec", client.settings.codec.String()),
+		slog.Bool("unreliable", client.datagram != nil))
 
 	return nil
 }
 
+// Stats returns a snapshot of the client's metrics. Counters accumulate across connections.
+func (client *Client[S, R]) Stats() ClientStats {
+	return ClientStats{
+		Connected:        client.connected.Load(),
+		HandshakesFailed: client.metrics.handshakesFailed.Load(),
+		MessagesSent:     client.metrics.traffic.messagesOut.Load(),
+		MessagesReceived: client.metrics.traffic.messagesIn.Load(),
+		BytesSent:        client.metrics.traffic.bytesOut.Load(),
+		BytesReceived:    client.metrics.traffic.bytesIn.Load(),
+		EncodeErrors:     client.metrics.encodeErrors.Load(),
+		DecodeErrors:     client.metrics.decodeErrors.Load(),
+		DecryptErrors:    client.metrics.decryptErrors.Load(),
+		EventQueueDepth:  len(client.eventChannel),
+		HandshakeLatency: client.metrics.handshakeLatency.snapshot(),
+	}
+}
+
+// PublishExpvar publishes the client's metrics as an expvar variable with the given name, which is served at
+// /debug/vars by the default HTTP mux. Names can only be published once per process.
+func (client *Client[S, R]) PublishExpvar(name string) error {
+	return publishExpvar(name, func() any {
+		return client.Stats()
+	})
+}
+
 // Disconnect from the server
 func (client *Client[S, R]) Disconnect() error {
-	if !client.connected {
+	if !client.connected.Load() {
 		return fmt.Errorf("client is not connected to a server")
 	}
 
-	client.connected = false
+	client.connected.Store(false)
 
 	err := client.sock.Close()
 	if err != nil {
 		return err
 	}
+	if client.config.unreliable {
+		// Keep the closed socket, so that a concurrent SendUnreliable fails with net.ErrClosed instead of racing
+		err = client.datagramSock.Close()
+		if err != nil {
+			return err
+		}
+	}
 
 	client.wg.Wait()
 	close(client.eventChannel)
@@ -89,39 +208,263 @@ func (client *Client[S, R]) Disconnect() error {
 
 // Send data to the server
 func (client *Client[S, R]) Send(data S) error {
-	if !client.connected {
+	return client.SendWithMeta(data, nil)
+}
+
+// SendWithMeta sends data to the server along with headers, such as a W3C traceparent or a request ID, which are
+// carried alongside the payload and exposed on the server's receive event. Sending headers to a server that does not
+// support them fails with ErrHeadersUnsupported.
+func (client *Client[S, R]) SendWithMeta(data S, headers Headers) error {
+	if !client.connected.Load() {
+		return fmt.Errorf("client is not connected to a server")
+	}
+
+	return runInterceptors(client.outbound.get(), client.outboundMessage(data, headers, false), func(message Message[S]) error {
+		frame, err := client.encodeDataFrame(message.Data, message.Headers)
+		if err != nil {
+			client.metrics.encodeErrors.Add(1)
+			return err
+		}
+
+		err = client.write(frame)
+		if err != nil {
+			return err
+		}
+
+		client.metrics.traffic.sentMessage()
+		return nil
+	})
+}
+
+// SendUnreliable sends data to the server over the unreliable datagram channel. Messages may be dropped, and duplicated
+// messages are discarded.
+func (client *Client[S, R]) SendUnreliable(data S) error {
+	if !client.connected.Load() {
 		return fmt.Errorf("client is not connected to a server")
 	}
 
-	dataBytes, err := encodeObject(data)
+	if !client.config.unreliable {
+		return fmt.Errorf("unreliable messages are not enabled")
+	}
+
+	return runInterceptors(client.outbound.get(), client.outboundMessage(data, nil, true), func(message Message[S]) error {
+		frame, err := client.encodeDataFrame(message.Data, message.Headers)
+		if err != nil {
+			client.metrics.encodeErrors.Add(1)
+			return err
+		}
+
+		datagram, err := client.datagram.seal(datagramFromClient, datagramData, frame)
+		if err != nil {
+			return err
+		}
+
+		n, err := client.datagramSock.Write(datagram)
+		if err != nil {
+			return err
+		}
+
+		client.metrics.traffic.sentBytes(n)
+		client.metrics.traffic.sentMessage()
+		return nil
+	})
+}
+
+// OpenStream opens a new stream to the server
+func (client *Client[S, R]) OpenStream() (*Stream, error) {
+	if !client.connected.Load() {
+		return nil, fmt.Errorf("client is not connected to a server")
+	}
+
+	return client.streams.open(streamGeneric)
+}
+
+// SendStream sends everything read from a reader to the server over a new stream, in bounded chunks rather than as a
+// single message held in memory. The server receives a ServerStream event whose stream can be read until io.EOF. This
+// blocks until the reader is exhausted and the stream is closed, pausing while the server has too much unread data.
+// It returns once the last of the data is written to the connection, which does not confirm the server received it.
+func (client *Client[S, R]) SendStream(reader io.Reader) error {
+	stream, err := client.OpenStream()
 	if err != nil {
 		return err
 	}
 
-	encryptedData, err := aesEncrypt(client.key, dataBytes)
+	return copyToStream(stream, reader)
+}
+
+// SendFile offers a file to the server. The server receives a ServerFileOffer event, and once it accepts the offer
+// the file is sent in the background, reporting ClientFileProgress events and finally a ClientFileComplete event.
+func (client *Client[S, R]) SendFile(path string) (*FileTransfer, error) {
+	if !client.connected.Load() {
+		return nil, fmt.Errorf("client is not connected to a server")
+	}
+
+	stream, err := client.streams.open(streamFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	size := encodeMessageSize(uint64(len(encryptedData)))
-	buffer := append(size, encryptedData...)
+	return sendFile(stream, path, client.transferHooks())
+}
+
+// SetUnreliable sets whether the client sends and receives unreliable messages over UDP. The server must also have
+// unreliable messages enabled, or connecting fails with ErrIncompatiblePeer, and connecting waits until the server
+// acknowledges the datagram channel. This must be set before the client connects.
+func (client *Client[S, R]) SetUnreliable(enabled bool) error {
+	if client.connected.Load() {
+		return fmt.Errorf("client is already connected to a server")
+	}
+
+	client.config.unreliable = enabled
+
+	return nil
+}
 
-	_, err = client.sock.Write(buffer)
+// SetCompression sets whether messages are compressed. When enabled, and if the server also has compression enabled,
+// messages are compressed if their encoded size is at least the threshold in bytes. This must be set before the client
+// connects.
+func (client *Client[S, R]) SetCompression(enabled bool, threshold int) error {
+	if client.connected.Load() {
+		return fmt.Errorf("client is already connected to a server")
+	}
+
+	client.config.compression = enabled
+	client.config.compressionThreshold = threshold
+
+	return nil
+}
+
+// SetCodecs sets the codecs the client can encode messages with, in order of preference. The first codec also
+// supported by the server is used. This must be set before the client connects.
+func (client *Client[S, R]) SetCodecs(codecs ...Codec) error {
+	if client.connected.Load() {
+		return fmt.Errorf("client is already connected to a server")
+	}
+
+	err := checkCodecs[S, R](codecs)
 	if err != nil {
 		return err
 	}
 
+	client.config.codecs = codecs
+
+	return nil
+}
+
+// SetRegistry sets the registry of message types the client sends and receives. Each message is tagged with its
+// registered type name, and received messages are decoded into their registered types, so S and R are typically
+// interfaces satisfied by every registered type. A message with an unknown type produces an error event. This must be
+// set before the client connects.
+func (client *Client[S, R]) SetRegistry(registry *Registry) error {
+	if client.connected.Load() {
+		return fmt.Errorf("client is already connected to a server")
+	}
+
+	client.config.registry = registry
+
+	return nil
+}
+
+// SetValidation sets what happens when the server sends a message that cannot be decoded or fails validation. Messages
+// are validated with their Validate method if their type implements Validator, and then with the given validation
+// function, if it is not nil. Invalid messages produce an error event wrapping ErrInvalidMessage, and under
+// ValidationDisconnect the connection is then closed. This must be set before the client connects.
+func (client *Client[S, R]) SetValidation(policy ValidationPolicy, validate func(data R) error) error {
+	if client.connected.Load() {
+		return fmt.Errorf("client is already connected to a server")
+	}
+
+	client.validation = policy
+	client.validate = validate
+
+	return nil
+}
+
+// InterceptInbound adds interceptors that run on each message received from the server, before it is routed or
+// emitted. A message rejected by an interceptor is dropped and produces an error event.
+func (client *Client[S, R]) InterceptInbound(interceptors ...Interceptor[R]) {
+	client.inbound.add(interceptors...)
+}
+
+// InterceptOutbound adds interceptors that run on each message sent to the server, before it is encoded. A message
+// rejected by an interceptor fails the send with the interceptor's error.
+func (client *Client[S, R]) InterceptOutbound(interceptors ...Interceptor[S]) {
+	client.outbound.add(interceptors...)
+}
+
+// SetLogger sets the logger that connections, failed handshakes, protocol errors and disconnect reasons are logged to.
+// Records carry the server's remote address. Nothing is logged by default, and a nil logger disables logging again.
+// This must be set before the client connects.
+func (client *Client[S, R]) SetLogger(logger *slog.Logger) error {
+	if client.connected.Load() {
+		return fmt.Errorf("client is already connected to a server")
+	}
+
+	client.logger = loggerOrDiscard(logger)
+
+	return nil
+}
+
+// SetRouter sets the router that messages received from the server are dispatched to. Messages the router has no
+// handler for are emitted as receive events, and handler errors are emitted as error events. This must be set before
+// the client connects.
+func (client *Client[S, R]) SetRouter(router *Router[R]) error {
+	if client.connected.Load() {
+		return fmt.Errorf("client is already connected to a server")
+	}
+
+	client.router = router
+
+	return nil
+}
+
+// SetHeartbeat sets the interval at which heartbeats are sent to the server, if the server also has heartbeats
+// enabled. The longer of the two intervals is used, and if the server sends nothing for several intervals the client
+// disconnects. An interval of 0 disables heartbeats. This must be set before the client connects.
+func (client *Client[S, R]) SetHeartbeat(interval time.Duration) error {
+	if client.connected.Load() {
+		return fmt.Errorf("client is already connected to a server")
+	}
+
+	client.config.heartbeat = interval
+
+	return nil
+}
+
+// SetMaxStreams sets how many streams the server can have open to the client at once. Opening more closes the
+// connection with ErrTooManyStreams. A limit of 0 disables the limit. The default is 256. This must be set before the
+// client connects.
+func (client *Client[S, R]) SetMaxStreams(limit int) error {
+	if client.connected.Load() {
+		return fmt.Errorf("client is already connected to a server")
+	}
+
+	client.config.maxStreams = limit
+
+	return nil
+}
+
+// SetMaxMessageSize sets the maximum size of a message sent or received, in bytes, once encrypted or decompressed.
+// Sending a larger message fails with ErrMessageTooLarge, and receiving one disconnects the client. A size of 0
+// disables the limit. The default is 64 MiB. This must be set before the client connects.
+func (client *Client[S, R]) SetMaxMessageSize(size int) error {
+	if client.connected.Load() {
+		return fmt.Errorf("client is already connected to a server")
+	}
+
+	client.config.maxMessageSize = size
+
 	return nil
 }
 
 // Connected returns a boolean value representing whether the client is connected to a server
 func (client *Client[S, R]) Connected() bool {
-	return client.connected
+	return client.connected.Load()
 }
 
 // GetAddr returns the client's address
 func (client *Client[S, R]) GetAddr() (string, uint16, error) {
-	if !client.connected {
+	if !client.connected.Load() {
 		return "", 0, fmt.Errorf("client is not connected to a server")
 	}
 
@@ -130,7 +473,7 @@ func (client *Client[S, R]) GetAddr() (string, uint16, error) {
 
 // GetServerAddr returns the server's address
 func (client *Client[S, R]) GetServerAddr() (string, uint16, error) {
-	if !client.connected {
+	if !client.connected.Load() {
 		return "", 0, fmt.Errorf("client is not connected to a server")
 	}
 
@@ -140,77 +483,398 @@ func (client *Client[S, R]) GetServerAddr() (string, uint16, error) {
 // Handle client events
 func (client *Client[S, R]) handle() {
 	defer client.wg.Done()
+	defer client.streams.close(fmt.Errorf("connection closed"))
+
+	readTimeout := client.settings.readTimeout()
+	if client.settings.capabilities.Has(CapabilityHeartbeat) {
+		done := make(chan struct{})
+		defer close(done)
+		go sendHeartbeats(client.settings.heartbeat, done, client.write)
+	}
 
-	sizeBuffer := make([]byte, lenSize)
+	// The error reported in the disconnect event, and the reason the connection ended, which is only logged
+	var disconnectErr, reason error
+	for client.connected.Load() {
+		if readTimeout > 0 {
+			client.sock.SetReadDeadline(time.Now().Add(readTimeout))
+		}
 
-	for client.connected {
-		_, err := client.sock.Read(sizeBuffer)
+		buffer, err := readMessage(client.sock, client.config.maxMessageSize)
 		if err != nil {
+			reason = err
 			break
 		}
+		client.metrics.traffic.receivedBytes(lenSize + len(buffer))
 
-		msgSize := decodeMessageSize(sizeBuffer)
-		buffer := make([]byte, msgSize)
-		_, err = client.sock.Read(buffer)
+		frame, err := aeadDecrypt(client.key, buffer)
 		if err != nil {
+			client.metrics.decryptErrors.Add(1)
+			reason = fmt.Errorf("failed to decrypt message: %w", err)
 			break
 		}
 
-		dataBytes, err := aesDecrypt(client.key, buffer)
+		header, dataBytes, err := decodeFrame(frame, client.config.maxMessageSize)
 		if err != nil {
+			reason = fmt.Errorf("malformed frame: %w", err)
 			break
 		}
 
-		data, err := decodeObject[R](dataBytes)
-		if err != nil {
+		if isStreamFrame(header.kind) {
+			err = client.streams.handle(header, dataBytes)
+			if err != nil {
+				if errors.Is(err, ErrTooManyStreams) {
+					disconnectErr = ErrTooManyStreams
+				}
+				reason = fmt.Errorf("stream error: %w", err)
+				break
+			}
+			continue
+		}
+
+		if header.kind == frameClose {
+			disconnectErr = fmt.Errorf("%w: %s", ErrConnectionClosed, dataBytes)
 			break
 		}
 
-		client.eventChannel <- ClientEvent[R]{
-			EventType: ClientReceive,
-			Data:      data,
+		if header.kind != frameData {
+			continue
 		}
+		client.metrics.traffic.receivedMessage()
+
+		data, err := decodeValidData(dataBytes, client.settings.codec, client.config.registry, client.validate)
+		if err != nil {
+			client.metrics.decodeErrors.Add(1)
+			client.log.Warn("invalid message", slog.Any("error", err))
+			client.eventChannel <- ClientEvent[R]{
+				EventType: ClientError,
+				Err:       err,
+			}
+			if errors.Is(err, ErrUnknownMessageType) || client.validation == ValidationSkip {
+				continue
+			}
+			reason = err
+			break
+		}
+
+		client.receive(data, header.headers, false)
 	}
 
-	if client.connected {
-		client.connected = false
-		// Ignore socket close error
+	if disconnectErr != nil {
+		reason = disconnectErr
+	}
+	if !client.connected.Load() {
+		// The connection was closed by Disconnect
+		reason = nil
+	}
+	logDisconnect(client.log, "disconnected from server", reason)
+
+	if client.connected.Load() {
+		client.connected.Store(false)
+		// Ignore socket close errors
 		client.sock.Close()
+		if client.config.unreliable {
+			client.datagramSock.Close()
+		}
 
 		client.eventChannel <- ClientEvent[R]{
 			EventType: ClientDisconnected,
+			Err:       disconnectErr,
+		}
+	}
+}
+
+// Pass a message received from the server through the inbound interceptors, then route or emit it
+func (client *Client[S, R]) receive(data R, headers Headers, unreliable bool) {
+	message := Message[R]{
+		Type:       messageType(data, client.config.registry),
+		Data:       data,
+		Unreliable: unreliable,
+		Headers:    headers,
+	}
+
+	err := runInterceptors(client.inbound.get(), message, client.deliver)
+	if err != nil {
+		client.eventChannel <- ClientEvent[R]{
+			EventType:  ClientError,
+			Data:       data,
+			Unreliable: unreliable,
+			Err:        err,
+			Headers:    headers,
+		}
+	}
+}
+
+// Route a message received from the server, or emit it if it is not handled. Handler errors are emitted rather than
+// returned, so they are not mistaken for rejections by interceptors.
+func (client *Client[S, R]) deliver(message Message[R]) error {
+	if client.router != nil {
+		handled, err := client.router.dispatch(message)
+		if err != nil {
+			client.eventChannel <- ClientEvent[R]{
+				EventType:  ClientError,
+				Data:       message.Data,
+				Unreliable: message.Unreliable,
+				Err:        err,
+				Headers:    message.Headers,
+			}
 		}
+		if handled {
+			return nil
+		}
+	}
+
+	client.eventChannel <- ClientEvent[R]{
+		EventType:  ClientReceive,
+		Data:       message.Data,
+		Unreliable: message.Unreliable,
+		Headers:    message.Headers,
+	}
+
+	return nil
+}
+
+// Build the message passed to outbound interceptors for data sent to the server
+func (client *Client[S, R]) outboundMessage(data S, headers Headers, unreliable bool) Message[S] {
+	return Message[S]{
+		Type:       messageType(data, client.config.registry),
+		Data:       data,
+		Unreliable: unreliable,
+		Headers:    headers.Clone(),
+	}
+}
+
+// Handle datagrams from the server
+func (client *Client[S, R]) handleDatagrams() {
+	defer client.wg.Done()
+
+	datagramSock := client.datagramSock
+	session := client.datagram
+	buffer := make([]byte, maxDatagramSize)
+
+	for client.connected.Load() {
+		n, err := datagramSock.Read(buffer)
+		if err != nil {
+			if !client.connected.Load() {
+				break
+			} else {
+				continue
+			}
+		}
+
+		sessionID, ok := datagramSessionID(buffer[:n])
+		if !ok || sessionID != session.id {
+			continue
+		}
+
+		kind, frame, err := session.open(datagramFromServer, buffer[:n])
+		if err != nil {
+			client.metrics.decryptErrors.Add(1)
+			client.log.Debug("failed to open datagram", slog.Any("error", err))
+			continue
+		}
+		client.metrics.traffic.receivedBytes(n)
+
+		if kind != datagramData {
+			continue
+		}
+
+		header, dataBytes, err := decodeFrame(frame, client.config.maxMessageSize)
+		if err != nil || header.kind != frameData {
+			continue
+		}
+		client.metrics.traffic.receivedMessage()
+
+		data, err := decodeValidData(dataBytes, client.settings.codec, client.config.registry, client.validate)
+		if err != nil {
+			client.metrics.decodeErrors.Add(1)
+			// Invalid datagrams are always dropped, since the connection does not depend on them
+			client.log.Warn("invalid message", slog.Bool("unreliable", true), slog.Any("error", err))
+			client.eventChannel <- ClientEvent[R]{
+				EventType:  ClientError,
+				Unreliable: true,
+				Err:        err,
+			}
+			continue
+		}
+
+		client.receive(data, header.headers, true)
+	}
+}
+
+// Open the datagram channel and register it with the server
+func (client *Client[S, R]) connectDatagrams() error {
+	tcpAddr, ok := client.sock.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("unreliable messages require a TCP connection")
+	}
+
+	session, err := newDatagramSession(client.key)
+	if err != nil {
+		return err
+	}
+
+	datagramSock, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port})
+	if err != nil {
+		return err
+	}
+
+	err = registerDatagrams(datagramSock, session)
+	if err != nil {
+		datagramSock.Close()
+		return err
+	}
+
+	client.datagram = session
+	client.datagramSock = datagramSock
+	client.wg.Add(1)
+	go client.handleDatagrams()
+
+	return nil
+}
+
+// Encode data and build the plaintext of a data frame
+func (client *Client[S, R]) encodeDataFrame(data S, headers Headers) ([]byte, error) {
+	if len(headers) > 0 && !client.settings.capabilities.Has(CapabilityHeaders) {
+		return []byte{}, ErrHeadersUnsupported
+	}
+
+	dataBytes, err := encodeData(data, client.settings.codec, client.config.registry)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	compressing := client.settings.capabilities.Has(CapabilityCompression)
+	header := frameHeader{kind: frameData, headers: headers}
+	return encodeFrame(header, dataBytes, compressing, client.config.compressionThreshold)
+}
+
+// Encrypt a frame and write it to the server
+func (client *Client[S, R]) write(frame []byte) error {
+	encryptedData, err := aeadEncrypt(client.key, frame)
+	if err != nil {
+		return err
 	}
+
+	err = checkMessageSize(encryptedData, client.config.maxMessageSize)
+	if err != nil {
+		return err
+	}
+
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+
+	n, err := client.sock.Write(encodeMessage(encryptedData))
+	client.metrics.traffic.sentBytes(n)
+	return err
 }
 
-// Exchange crypto keys with the server
+// Build a frame and write it to the server
+func (client *Client[S, R]) writeFrame(header frameHeader, data []byte) error {
+	compressing := client.settings.capabilities.Has(CapabilityCompression)
+	frame, err := encodeFrame(header, data, compressing, client.config.compressionThreshold)
+	if err != nil {
+		return err
+	}
+
+	return client.write(frame)
+}
+
+// Get the hooks file transfers use to report events
+func (client *Client[S, R]) transferHooks() transferHooks {
+	eventTypes := map[fileEvent]ClientEventType{
+		fileOffered:  ClientFileOffer,
+		fileProgress: ClientFileProgress,
+		fileComplete: ClientFileComplete,
+	}
+
+	return transferHooks{
+		emit: func(event fileEvent, transfer *FileTransfer) {
+			client.eventChannel <- ClientEvent[R]{
+				EventType: eventTypes[event],
+				File:      transfer,
+			}
+		},
+		spawn: func(f func()) {
+			client.wg.Add(1)
+			go func() {
+				defer client.wg.Done()
+				f()
+			}()
+		},
+	}
+}
+
+// Exchange crypto keys and negotiate protocol settings with the server
 func (client *Client[S, R]) exchangeKeys() error {
-	pub := rsa.PublicKey{}
-	dec := gob.NewDecoder(client.sock)
-	err := dec.Decode(&pub)
+	hello := serverHello{}
+	dec := gob.NewDecoder(io.LimitReader(client.sock, maxHandshakeSize))
+	err := dec.Decode(&hello)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrIncompatiblePeer, err)
+	}
+
+	choice, err := client.config.negotiate(hello)
 	if err != nil {
 		return err
 	}
 
+	err = checkPublicKey(hello.PublicKey)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrIncompatiblePeer, err)
+	}
+
 	key, err := newAESKey()
 	if err != nil {
 		return err
 	}
 
-	encryptedKey, err := rsaEncrypt(pub, key)
+	encryptedKey, err := rsaEncrypt(hello.PublicKey, key)
 	if err != nil {
 		return err
 	}
 
-	size := encodeMessageSize(uint64(len(encryptedKey)))
-	buffer := append(size, encryptedKey...)
+	_, err = client.sock.Write(encodeMessage(encryptedKey))
+	if err != nil {
+		return err
+	}
+
+	choiceBytes, err := encodeHandshake(&choice)
+	if err != nil {
+		return err
+	}
 
-	_, err = client.sock.Write(buffer)
+	encryptedChoice, err := aeadEncrypt(key, choiceBytes)
 	if err != nil {
 		return err
 	}
 
+	_, err = client.sock.Write(encodeMessage(encryptedChoice))
+	if err != nil {
+		return err
+	}
+
+	encryptedAccept, err := readMessageLimit(client.sock, maxHandshakeSize)
+	if err != nil {
+		return err
+	}
+
+	acceptBytes, err := aeadDecrypt(key, encryptedAccept)
+	if err != nil {
+		return err
+	}
+
+	accept := serverAccept{}
+	err = decodeHandshake(acceptBytes, &accept)
+	if err != nil {
+		return err
+	}
+
+	if accept.Error != "" {
+		return fmt.Errorf("%w: %s", ErrIncompatiblePeer, accept.Error)
+	}
+
 	client.key = key
+	client.settings = choice.settings()
 
 	return nil
 }
@@ -0,0 +1,95 @@
+package godtp
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ClientInfo defines a snapshot of the state of a connected client
+type ClientInfo struct {
+	ID                uint
+	RemoteAddr        net.Addr
+	ConnectedAt       time.Time
+	LastActivity      time.Time
+	BytesIn           uint64
+	BytesOut          uint64
+	MessagesIn        uint64
+	MessagesOut       uint64
+	Version           uint
+	Capabilities      Capabilities
+	Codec             Codec
+	HeartbeatInterval time.Duration
+	Unreliable        bool
+}
+
+// Counters of the traffic on a connection, which also update the totals they belong to, if any
+type connectionStats struct {
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+	messagesIn  atomic.Uint64
+	messagesOut atomic.Uint64
+	lastActive  atomic.Int64
+	totals      *connectionStats
+}
+
+// Record bytes received
+func (stats *connectionStats) receivedBytes(n int) {
+	stats.bytesIn.Add(uint64(n))
+	if stats.totals != nil {
+		stats.totals.receivedBytes(n)
+	}
+}
+
+// Record bytes sent
+func (stats *connectionStats) sentBytes(n int) {
+	stats.bytesOut.Add(uint64(n))
+	if stats.totals != nil {
+		stats.totals.sentBytes(n)
+	}
+}
+
+// Record a message received
+func (stats *connectionStats) receivedMessage() {
+	stats.messagesIn.Add(1)
+	if stats.totals != nil {
+		stats.totals.receivedMessage()
+	}
+}
+
+// Record a message sent
+func (stats *connectionStats) sentMessage() {
+	stats.messagesOut.Add(1)
+	if stats.totals != nil {
+		stats.totals.sentMessage()
+	}
+}
+
+// Record that something other than a heartbeat was received
+func (stats *connectionStats) active() {
+	stats.lastActive.Store(time.Now().UnixNano())
+}
+
+// Get the last time something other than a heartbeat was received
+func (stats *connectionStats) lastActivity() time.Time {
+	return time.Unix(0, stats.lastActive.Load())
+}
+
+// Get a snapshot of a client's state
+func (client *serverClient) info() ClientInfo {
+	return ClientInfo{
+		ID:                client.id,
+		RemoteAddr:        client.conn.RemoteAddr(),
+		ConnectedAt:       client.connectedAt,
+		LastActivity:      client.stats.lastActivity(),
+		BytesIn:           client.stats.bytesIn.Load(),
+		BytesOut:          client.stats.bytesOut.Load(),
+		MessagesIn:        client.stats.messagesIn.Load(),
+		MessagesOut:       client.stats.messagesOut.Load(),
+		Version:           client.settings.version,
+		Capabilities:      client.settings.capabilities,
+		Codec:             client.settings.codec,
+		HeartbeatInterval: client.settings.heartbeat,
+		Unreliable:        client.datagram != nil,
+	}
+}
@@ -0,0 +1,99 @@
+package godtp
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+)
+
+// Codec defines the format messages are encoded with
+type Codec uint8
+
+// Codec values
+const (
+	CodecJSON Codec = iota
+	CodecGob
+	CodecRaw
+)
+
+// String returns the name of the codec
+func (codec Codec) String() string {
+	switch codec {
+	case CodecJSON:
+		return "json"
+	case CodecGob:
+		return "gob"
+	case CodecRaw:
+		return "raw"
+	default:
+		return fmt.Sprintf("Codec(%d)", codec)
+	}
+}
+
+// The codecs used when none are configured
+var defaultCodecs = []Codec{CodecJSON}
+
+// Encode an object using a codec
+func encodeObjectCodec[T any](object T, codec Codec) ([]byte, error) {
+	switch codec {
+	case CodecJSON:
+		return encodeObject(object)
+	case CodecRaw:
+		raw, ok := any(object).([]byte)
+		if !ok {
+			return []byte{}, fmt.Errorf("raw codec requires a byte slice")
+		}
+		return raw, nil
+	case CodecGob:
+		var buffer bytes.Buffer
+		err := gob.NewEncoder(&buffer).Encode(&object)
+		return buffer.Bytes(), err
+	default:
+		return []byte{}, fmt.Errorf("unknown codec")
+	}
+}
+
+// Decode an object using a codec
+func decodeObjectCodec[T any](byteString []byte, codec Codec) (T, error) {
+	switch codec {
+	case CodecJSON:
+		return decodeObject[T](byteString)
+	case CodecRaw:
+		var object T
+		raw, ok := any(&object).(*[]byte)
+		if !ok {
+			return object, fmt.Errorf("raw codec requires a byte slice")
+		}
+		*raw = byteString
+		return object, nil
+	case CodecGob:
+		var object T
+		err := gob.NewDecoder(bytes.NewReader(byteString)).Decode(&object)
+		return object, err
+	default:
+		var object T
+		return object, fmt.Errorf("unknown codec")
+	}
+}
+
+// Check whether a type can be sent with the raw codec
+func isRawType[T any]() bool {
+	var object T
+	_, ok := any(object).([]byte)
+	return ok
+}
+
+// Check that the given codecs can be used with the message types S and R
+func checkCodecs[S any, R any](codecs []Codec) error {
+	if len(codecs) == 0 {
+		return fmt.Errorf("at least one codec is required")
+	}
+
+	for _, codec := range codecs {
+		if codec == CodecRaw && (!isRawType[S]() || !isRawType[R]()) {
+			return fmt.Errorf("raw codec requires byte slice message types")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package godtp
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// Compress data using DEFLATE
+func compress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	writer, err := flate.NewWriter(&buffer, flate.DefaultCompression)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	_, err = writer.Write(data)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return []byte{}, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// Decompress DEFLATE data, failing if it expands beyond the given maximum message size, unless it is 0
+func decompress(data []byte, maxSize int) ([]byte, error) {
+	reader := io.Reader(flate.NewReader(bytes.NewReader(data)))
+	if maxSize > 0 {
+		reader = io.LimitReader(reader, int64(maxSize)+1)
+	}
+
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		return []byte{}, err
+	}
+	if maxSize > 0 && len(decompressed) > maxSize {
+		return []byte{}, fmt.Errorf("%w: decompressed data exceeds %d bytes", ErrMessageTooLarge, maxSize)
+	}
+
+	return decompressed, nil
+}
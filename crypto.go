@@ -26,6 +26,19 @@ func newRSAKeys() (*rsa.PrivateKey, error) {
 	return privateKey, err
 }
 
+// Check that a peer's RSA public key is usable and at least as strong as the keys generated locally
+func checkPublicKey(publicKey rsa.PublicKey) error {
+	if publicKey.N == nil || publicKey.N.Sign() <= 0 || publicKey.N.BitLen() < rsaKeySize {
+		return fmt.Errorf("invalid RSA public key")
+	}
+
+	if publicKey.E < 3 || publicKey.E%2 == 0 {
+		return fmt.Errorf("invalid RSA public exponent")
+	}
+
+	return nil
+}
+
 // Encrypt using RSA
 func rsaEncrypt(publicKey rsa.PublicKey, plaintext []byte) ([]byte, error) {
 	rng := rand.Reader
@@ -49,38 +62,50 @@ func newAESKey() ([]byte, error) {
 	return key, err
 }
 
-// Encrypt using AES
-func aesEncrypt(key, plaintext []byte) ([]byte, error) {
+// Derive a new key from an existing key and a label
+func deriveKey(key []byte, label string) []byte {
+	hash := sha256.New()
+	hash.Write([]byte(label))
+	hash.Write(key)
+	return hash.Sum(nil)
+}
+
+// Create an AES-GCM AEAD cipher
+func newAEAD(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Encrypt using AES-GCM
+func aeadEncrypt(key, plaintext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
 	if err != nil {
 		return []byte{}, err
 	}
 
-	ciphertext := make([]byte, aes.BlockSize+len(plaintext))
-	nonce := ciphertext[:aes.BlockSize]
+	nonce := make([]byte, aead.NonceSize())
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return []byte{}, err
 	}
 
-	cfb := cipher.NewCFBEncrypter(block, nonce)
-	cfb.XORKeyStream(ciphertext[aes.BlockSize:], plaintext)
-	return ciphertext, nil
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
 }
 
-// Decrypt using AES
-func aesDecrypt(key []byte, ciphertext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+// Decrypt using AES-GCM
+func aeadDecrypt(key []byte, ciphertext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
 	if err != nil {
 		return []byte{}, err
 	}
 
-	if len(ciphertext) < aes.BlockSize {
+	if len(ciphertext) < aead.NonceSize() {
 		return []byte{}, fmt.Errorf("ciphertext too short")
 	}
 
-	nonce := ciphertext[:aes.BlockSize]
-	plaintext := ciphertext[aes.BlockSize:]
-	cfb := cipher.NewCFBDecrypter(block, nonce)
-	cfb.XORKeyStream(plaintext, plaintext)
-	return plaintext, nil
+	nonce := ciphertext[:aead.NonceSize()]
+	return aead.Open(nil, nonce, ciphertext[aead.NonceSize():], nil)
 }
@@ -0,0 +1,233 @@
+package godtp
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The size of the session ID portion of a datagram
+const sessionIDSize = 8
+
+// The size of the sequence number portion of a datagram
+const seqSize = 8
+
+// The size of a datagram header
+const datagramHeaderSize = sessionIDSize + seqSize + 1
+
+// The maximum size of a UDP datagram payload
+const maxDatagramSize = 65507
+
+// The number of sequence numbers tracked for replay rejection
+const replayWindowSize = 64
+
+// Datagram key derivation label
+const datagramKeyLabel = "godtp datagram key"
+
+// Datagram session ID derivation label
+const datagramSessionLabel = "godtp datagram session"
+
+// The number of times a client sends its datagram registration before giving up
+const datagramRegisterAttempts = 5
+
+// How long a client waits for its datagram registration to be acknowledged before sending it again
+const datagramRegisterInterval = 200 * time.Millisecond
+
+// Datagram kinds. The server acknowledges a registration by sending one back.
+const (
+	datagramData byte = iota
+	datagramRegister
+)
+
+// Datagram directions, used to keep the nonces of both peers distinct
+const (
+	datagramFromClient byte = iota
+	datagramFromServer
+)
+
+// Tracks recently received sequence numbers to reject replayed datagrams
+type replayWindow struct {
+	highest uint64
+	bitmap  uint64
+}
+
+// Check whether a sequence number has not been seen and is not too old
+func (window *replayWindow) check(seq uint64) bool {
+	if seq == 0 {
+		return false
+	}
+
+	if seq > window.highest {
+		return true
+	}
+
+	diff := window.highest - seq
+	if diff >= replayWindowSize {
+		return false
+	}
+
+	return window.bitmap&(1<<diff) == 0
+}
+
+// Mark a sequence number as seen
+func (window *replayWindow) update(seq uint64) {
+	if seq > window.highest {
+		diff := seq - window.highest
+		if diff >= replayWindowSize {
+			window.bitmap = 0
+		} else {
+			window.bitmap <<= diff
+		}
+		window.bitmap |= 1
+		window.highest = seq
+	} else {
+		window.bitmap |= 1 << (window.highest - seq)
+	}
+}
+
+// The state of an unreliable datagram channel associated with a connection
+type datagramSession struct {
+	id      uint64
+	aead    cipher.AEAD
+	sendSeq atomic.Uint64
+	mutex   sync.Mutex
+	window  replayWindow
+	addr    *net.UDPAddr
+}
+
+// Create a new datagram session from a connection's key
+func newDatagramSession(key []byte) (*datagramSession, error) {
+	aead, err := newAEAD(deriveKey(key, datagramKeyLabel))
+	if err != nil {
+		return nil, err
+	}
+
+	id := binary.BigEndian.Uint64(deriveKey(key, datagramSessionLabel))
+
+	return &datagramSession{
+		id:   id,
+		aead: aead,
+	}, nil
+}
+
+// Build the nonce for a datagram
+func datagramNonce(direction byte, seq uint64) []byte {
+	nonce := make([]byte, 12)
+	nonce[3] = direction
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+// Encrypt and frame a datagram
+func (session *datagramSession) seal(direction byte, kind byte, payload []byte) ([]byte, error) {
+	if datagramHeaderSize+len(payload)+session.aead.Overhead() > maxDatagramSize {
+		return []byte{}, fmt.Errorf("message is too large to be sent unreliably")
+	}
+
+	seq := session.sendSeq.Add(1)
+	header := make([]byte, datagramHeaderSize)
+	binary.BigEndian.PutUint64(header, session.id)
+	binary.BigEndian.PutUint64(header[sessionIDSize:], seq)
+	header[sessionIDSize+seqSize] = kind
+
+	ciphertext := session.aead.Seal(nil, datagramNonce(direction, seq), payload, header)
+	return append(header, ciphertext...), nil
+}
+
+// Authenticate and decrypt a datagram, rejecting replays
+func (session *datagramSession) open(direction byte, datagram []byte) (byte, []byte, error) {
+	if len(datagram) < datagramHeaderSize {
+		return 0, []byte{}, fmt.Errorf("datagram too short")
+	}
+
+	header := datagram[:datagramHeaderSize]
+	seq := binary.BigEndian.Uint64(header[sessionIDSize:])
+	kind := header[sessionIDSize+seqSize]
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if !session.window.check(seq) {
+		return 0, []byte{}, fmt.Errorf("datagram rejected as a replay")
+	}
+
+	payload, err := session.aead.Open(nil, datagramNonce(direction, seq), datagram[datagramHeaderSize:], header)
+	if err != nil {
+		return 0, []byte{}, err
+	}
+
+	session.window.update(seq)
+
+	return kind, payload, nil
+}
+
+// Get the session ID of a datagram
+func datagramSessionID(datagram []byte) (uint64, bool) {
+	if len(datagram) < datagramHeaderSize {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint64(datagram), true
+}
+
+// Get the address datagrams for the session are sent to
+func (session *datagramSession) getAddr() *net.UDPAddr {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return session.addr
+}
+
+// Set the address datagrams for the session are sent to
+func (session *datagramSession) setAddr(addr *net.UDPAddr) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.addr = addr
+}
+
+// Register a client's datagram channel with the server, sending the registration again until the server acknowledges
+// it. Other datagrams received before the acknowledgement are dropped.
+func registerDatagrams(datagramSock *net.UDPConn, session *datagramSession) error {
+	defer datagramSock.SetReadDeadline(time.Time{})
+	buffer := make([]byte, maxDatagramSize)
+
+	for attempt := 0; attempt < datagramRegisterAttempts; attempt++ {
+		datagram, err := session.seal(datagramFromClient, datagramRegister, []byte{})
+		if err != nil {
+			return err
+		}
+
+		_, err = datagramSock.Write(datagram)
+		if err != nil {
+			return err
+		}
+
+		deadline := time.Now().Add(datagramRegisterInterval)
+		datagramSock.SetReadDeadline(deadline)
+		for {
+			n, err := datagramSock.Read(buffer)
+			if err != nil {
+				// Errors such as an unreachable port are reported immediately, so wait out the interval anyway
+				time.Sleep(time.Until(deadline))
+				break
+			}
+
+			sessionID, ok := datagramSessionID(buffer[:n])
+			if !ok || sessionID != session.id {
+				continue
+			}
+
+			kind, _, err := session.open(datagramFromServer, buffer[:n])
+			if err == nil && kind == datagramRegister {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("server did not acknowledge the datagram channel")
+}
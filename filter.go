@@ -0,0 +1,119 @@
+package godtp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// ErrConnectionRejected is returned when a server refuses a connection
+var ErrConnectionRejected = errors.New("connection rejected")
+
+// ConnectionInfo describes an incoming connection that has not yet completed the key exchange
+type ConnectionInfo struct {
+	RemoteAddr net.Addr
+	// The metadata store the client will have once connected, which the filter can populate
+	Metadata *Metadata
+}
+
+// AcceptFilter defines a function that decides whether to accept an incoming connection. A connection is rejected if
+// the filter returns an error, and the error's message is sent to the client as the reason.
+type AcceptFilter func(info ConnectionInfo) error
+
+// IPFilter defines allow and deny lists of IP ranges
+type IPFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// NewIPFilter creates a filter from allow and deny lists of IP ranges in CIDR notation, such as "10.0.0.0/8". Single
+// addresses are also accepted. If the allow list is empty, every address not denied is allowed, and a denied address
+// is rejected even if it is also allowed.
+func NewIPFilter(allow []string, deny []string) (*IPFilter, error) {
+	allowPrefixes, err := parsePrefixes(allow)
+	if err != nil {
+		return nil, err
+	}
+
+	denyPrefixes, err := parsePrefixes(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IPFilter{
+		allow: allowPrefixes,
+		deny:  denyPrefixes,
+	}, nil
+}
+
+// Allowed returns a boolean value representing whether the filter allows an IP address
+func (filter *IPFilter) Allowed(ip netip.Addr) bool {
+	ip = ip.Unmap()
+
+	for _, prefix := range filter.deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(filter.allow) == 0 {
+		return true
+	}
+
+	for _, prefix := range filter.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Accept is an AcceptFilter that rejects connections from addresses the filter does not allow
+func (filter *IPFilter) Accept(info ConnectionInfo) error {
+	ip, ok := remoteIP(info.RemoteAddr)
+	if !ok {
+		return fmt.Errorf("unknown address")
+	}
+
+	if !filter.Allowed(ip) {
+		return fmt.Errorf("address not allowed")
+	}
+
+	return nil
+}
+
+// Parse IP ranges in CIDR notation, or single IP addresses
+func parsePrefixes(ranges []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(ranges))
+
+	for _, ipRange := range ranges {
+		prefix, err := netip.ParsePrefix(ipRange)
+		if err != nil {
+			ip, ipErr := netip.ParseAddr(ipRange)
+			if ipErr != nil {
+				return nil, fmt.Errorf("invalid IP range %q: %w", ipRange, err)
+			}
+			prefix = netip.PrefixFrom(ip, ip.BitLen())
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// Get the IP address of a remote network address
+func remoteIP(addr net.Addr) (netip.Addr, bool) {
+	if addr == nil {
+		return netip.Addr{}, false
+	}
+
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addrPort.Addr().Unmap(), true
+}
@@ -0,0 +1,158 @@
+package godtp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrConnectionClosed is reported when the peer closes the connection and gives a reason
+var ErrConnectionClosed = errors.New("connection closed by peer")
+
+// The size of the fixed portion of a frame header
+const frameHeaderSize = 2
+
+// The size of the optional ID portion of a frame header
+const frameIDSize = 8
+
+// The number of heartbeat intervals without receiving anything after which a peer is considered gone
+const heartbeatTolerance = 3
+
+// The amount of time allowed for telling a peer why it is being disconnected
+const closeWriteTimeout = time.Second
+
+// The kind of a frame
+type frameKind byte
+
+// Frame kinds. Every kind other than frameData carries control traffic, and control frames of unknown kinds are
+// ignored so that new kinds can be added without breaking older peers.
+const (
+	frameData frameKind = iota
+	framePing
+	framePong
+	frameClose
+	frameAck
+	frameStreamOpen
+	frameStreamData
+	frameStreamWindow
+	frameStreamClose
+)
+
+// Frame header flags
+const (
+	flagCompressed byte = 1 << iota
+	flagID
+	flagHeaders
+)
+
+// The header at the start of each frame's plaintext
+type frameHeader struct {
+	kind    frameKind
+	flags   byte
+	id      uint64
+	headers Headers
+}
+
+// Build the plaintext of a frame, compressing the data if it meets the threshold and compression reduces its size. A
+// non-zero ID is included in the header as a stream or correlation ID, and any message headers precede the data.
+func encodeFrame(header frameHeader, data []byte, compression bool, threshold int) ([]byte, error) {
+	flags := header.flags &^ (flagCompressed | flagID | flagHeaders)
+
+	if len(header.headers) > 0 {
+		headerBytes, err := encodeHeaders(header.headers)
+		if err != nil {
+			return []byte{}, err
+		}
+
+		data = append(headerBytes, data...)
+		flags |= flagHeaders
+	}
+
+	if compression && len(data) > 0 && len(data) >= threshold {
+		compressed, err := compress(data)
+		if err != nil {
+			return []byte{}, err
+		}
+
+		if len(compressed) < len(data) {
+			data = compressed
+			flags |= flagCompressed
+		}
+	}
+
+	size := frameHeaderSize
+	if header.id != 0 {
+		flags |= flagID
+		size += frameIDSize
+	}
+
+	frame := make([]byte, size, size+len(data))
+	frame[0] = byte(header.kind)
+	frame[1] = flags
+	if header.id != 0 {
+		binary.BigEndian.PutUint64(frame[frameHeaderSize:], header.id)
+	}
+
+	return append(frame, data...), nil
+}
+
+// Extract the header and data from the plaintext of a frame, failing if compressed data expands beyond the given
+// maximum message size, unless it is 0
+func decodeFrame(frame []byte, maxSize int) (frameHeader, []byte, error) {
+	if len(frame) < frameHeaderSize {
+		return frameHeader{}, []byte{}, fmt.Errorf("frame too short")
+	}
+
+	header := frameHeader{
+		kind:  frameKind(frame[0]),
+		flags: frame[1],
+	}
+	data := frame[frameHeaderSize:]
+
+	if header.flags&flagID != 0 {
+		if len(data) < frameIDSize {
+			return frameHeader{}, []byte{}, fmt.Errorf("frame too short")
+		}
+
+		header.id = binary.BigEndian.Uint64(data)
+		data = data[frameIDSize:]
+	}
+
+	if header.flags&flagCompressed != 0 {
+		var err error
+		data, err = decompress(data, maxSize)
+		if err != nil {
+			return header, data, err
+		}
+	}
+
+	if header.flags&flagHeaders != 0 {
+		var err error
+		header.headers, data, err = decodeHeaders(data)
+		if err != nil {
+			return frameHeader{}, []byte{}, err
+		}
+	}
+
+	return header, data, nil
+}
+
+// Send ping frames at an interval until done is closed or sending fails
+func sendHeartbeats(interval time.Duration, done <-chan struct{}, send func(frame []byte) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ping, _ := encodeFrame(frameHeader{kind: framePing}, []byte{}, false, 0)
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if send(ping) != nil {
+				return
+			}
+		}
+	}
+}
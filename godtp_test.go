@@ -1,11 +1,25 @@
 package godtp
 
 import (
+	"bytes"
 	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"log/slog"
 	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -153,13 +167,16 @@ func TestCrypto(t *testing.T) {
 	aesMessage := "Hello, AES!"
 	key, err := newAESKey()
 	assertNoErr(err, t)
-	aesEncrypted, err := aesEncrypt(key, []byte(aesMessage))
+	aesEncrypted, err := aeadEncrypt(key, []byte(aesMessage))
 	assertNoErr(err, t)
-	aesDecrypted, err := aesDecrypt(key, aesEncrypted)
+	aesDecrypted, err := aeadDecrypt(key, aesEncrypted)
 	assertNoErr(err, t)
 	aesDecryptedMessage := string(aesDecrypted[:])
 	assertEq(aesDecryptedMessage, aesMessage, t)
 	assertNe(aesEncrypted, []byte(aesMessage), t)
+	aesEncrypted[len(aesEncrypted)-1] ^= 1
+	_, err = aeadDecrypt(key, aesEncrypted)
+	assertNe(err, nil, t)
 
 	// Test encrypting an AES key with RSA
 	encryptedKey, err := rsaEncrypt(publicKey, key)
@@ -234,6 +251,7 @@ func TestAddresses(t *testing.T) {
 	assertEq(clientConnectEvent, ServerEvent[any]{
 		EventType: ServerConnect,
 		ClientID:  0,
+		Metadata:  newMetadata(),
 	}, t)
 
 	// Check that addresses match
@@ -260,6 +278,7 @@ func TestAddresses(t *testing.T) {
 	assertEq(clientDisconnectEvent, ServerEvent[any]{
 		EventType: ServerDisconnect,
 		ClientID:  0,
+		Metadata:  newMetadata(),
 	}, t)
 
 	// Stop server
@@ -308,6 +327,7 @@ func TestSend(t *testing.T) {
 	assertEq(clientConnectEvent, ServerEvent[string]{
 		EventType: ServerConnect,
 		ClientID:  0,
+		Metadata:  newMetadata(),
 	}, t)
 
 	// Send message to client
@@ -336,6 +356,7 @@ func TestSend(t *testing.T) {
 		EventType: ServerReceive,
 		ClientID:  0,
 		Data:      messageFromClient,
+		Metadata:  newMetadata(),
 	}, t)
 	time.Sleep(waitTime)
 
@@ -362,6 +383,7 @@ func TestSend(t *testing.T) {
 	assertEq(clientDisconnectEvent, ServerEvent[string]{
 		EventType: ServerDisconnect,
 		ClientID:  0,
+		Metadata:  newMetadata(),
 	}, t)
 
 	// Stop server
@@ -410,6 +432,7 @@ func TestLargeSend(t *testing.T) {
 	assertEq(clientConnectEvent, ServerEvent[[]byte]{
 		EventType: ServerConnect,
 		ClientID:  0,
+		Metadata:  newMetadata(),
 	}, t)
 
 	// Generate large messages
@@ -449,6 +472,7 @@ func TestLargeSend(t *testing.T) {
 		EventType: ServerReceive,
 		ClientID:  0,
 		Data:      largeMessageFromClient,
+		Metadata:  newMetadata(),
 	}, t)
 
 	// Disconnect from server
@@ -461,6 +485,7 @@ func TestLargeSend(t *testing.T) {
 	assertEq(clientDisconnectEvent, ServerEvent[[]byte]{
 		EventType: ServerDisconnect,
 		ClientID:  0,
+		Metadata:  newMetadata(),
 	}, t)
 
 	// Stop server
@@ -509,6 +534,7 @@ func TestSendingNumerousMessages(t *testing.T) {
 	assertEq(clientConnectEvent, ServerEvent[int]{
 		EventType: ServerConnect,
 		ClientID:  0,
+		Metadata:  newMetadata(),
 	}, t)
 
 	// Generate messages
@@ -543,6 +569,7 @@ func TestSendingNumerousMessages(t *testing.T) {
 			EventType: ServerReceive,
 			ClientID:  0,
 			Data:      serverMessage,
+			Metadata:  newMetadata(),
 		}, t)
 	}
 
@@ -565,6 +592,7 @@ func TestSendingNumerousMessages(t *testing.T) {
 	assertEq(clientDisconnectEvent, ServerEvent[int]{
 		EventType: ServerDisconnect,
 		ClientID:  0,
+		Metadata:  newMetadata(),
 	}, t)
 
 	// Stop server
@@ -613,6 +641,7 @@ func TestSendingCustomTypes(t *testing.T) {
 	assertEq(clientConnectEvent, ServerEvent[custom]{
 		EventType: ServerConnect,
 		ClientID:  0,
+		Metadata:  newMetadata(),
 	}, t)
 
 	// Messages
@@ -651,6 +680,7 @@ func TestSendingCustomTypes(t *testing.T) {
 		EventType: ServerReceive,
 		ClientID:  0,
 		Data:      serverMessage,
+		Metadata:  newMetadata(),
 	}, t)
 	time.Sleep(waitTime)
 
@@ -664,6 +694,7 @@ func TestSendingCustomTypes(t *testing.T) {
 	assertEq(clientDisconnectEvent, ServerEvent[custom]{
 		EventType: ServerDisconnect,
 		ClientID:  0,
+		Metadata:  newMetadata(),
 	}, t)
 
 	// Stop server
@@ -712,6 +743,7 @@ func TestMultipleClients(t *testing.T) {
 	assertEq(clientConnectEvent1, ServerEvent[string]{
 		EventType: ServerConnect,
 		ClientID:  0,
+		Metadata:  newMetadata(),
 	}, t)
 
 	// Check that first client addresses match
@@ -749,6 +781,7 @@ func TestMultipleClients(t *testing.T) {
 	assertEq(clientConnectEvent2, ServerEvent[string]{
 		EventType: ServerConnect,
 		ClientID:  1,
+		Metadata:  newMetadata(),
 	}, t)
 
 	// Check that second client addresses match
@@ -777,6 +810,7 @@ func TestMultipleClients(t *testing.T) {
 		EventType: ServerReceive,
 		ClientID:  0,
 		Data:      messageFromClient1,
+		Metadata:  newMetadata(),
 	}, t)
 
 	// Send response back to client 1
@@ -803,6 +837,7 @@ func TestMultipleClients(t *testing.T) {
 		EventType: ServerReceive,
 		ClientID:  1,
 		Data:      messageFromClient2,
+		Metadata:  newMetadata(),
 	}, t)
 
 	// Send response back to client 2
@@ -847,6 +882,7 @@ func TestMultipleClients(t *testing.T) {
 	assertEq(clientDisconnectEvent1, ServerEvent[string]{
 		EventType: ServerDisconnect,
 		ClientID:  0,
+		Metadata:  newMetadata(),
 	}, t)
 
 	// Client 2 disconnect from server
@@ -859,6 +895,7 @@ func TestMultipleClients(t *testing.T) {
 	assertEq(clientDisconnectEvent2, ServerEvent[string]{
 		EventType: ServerDisconnect,
 		ClientID:  1,
+		Metadata:  newMetadata(),
 	}, t)
 
 	// Stop server
@@ -907,6 +944,7 @@ func TestRemoveClient(t *testing.T) {
 	assertEq(clientConnectEvent, ServerEvent[any]{
 		EventType: ServerConnect,
 		ClientID:  0,
+		Metadata:  newMetadata(),
 	}, t)
 
 	// Remove the client
@@ -925,6 +963,7 @@ func TestRemoveClient(t *testing.T) {
 	assertEq(disconnectEvent, ServerEvent[any]{
 		EventType: ServerDisconnect,
 		ClientID:  0,
+		Metadata:  newMetadata(),
 	}, t)
 
 	// Check the client is not connected
@@ -976,6 +1015,7 @@ func TestStopServerWhileClientConnected(t *testing.T) {
 	assertEq(clientConnectEvent, ServerEvent[any]{
 		EventType: ServerConnect,
 		ClientID:  0,
+		Metadata:  newMetadata(),
 	}, t)
 
 	// Stop server
@@ -991,3 +1031,2973 @@ func TestStopServerWhileClientConnected(t *testing.T) {
 	}, t)
 	assert(!client.Connected(), t, "Client should not be connected")
 }
+
+// Test the datagram replay window
+func TestReplayWindow(t *testing.T) {
+	window := replayWindow{}
+
+	// Sequence numbers start at one
+	assert(!window.check(0), t, "Sequence number 0 should be rejected")
+	assert(window.check(1), t, "Sequence number 1 should be accepted")
+	window.update(1)
+	assert(!window.check(1), t, "Replayed sequence number should be rejected")
+
+	// Jump ahead, then accept late but unseen sequence numbers
+	window.update(10)
+	assert(window.check(5), t, "Late sequence number should be accepted")
+	window.update(5)
+	assert(!window.check(5), t, "Replayed late sequence number should be rejected")
+	assert(!window.check(10), t, "Replayed sequence number should be rejected")
+
+	// Sequence numbers that fall outside the window are rejected
+	window.update(10 + replayWindowSize)
+	assert(!window.check(9), t, "Stale sequence number should be rejected")
+	assert(window.check(11), t, "Sequence number within the window should be accepted")
+
+	// Datagrams can be opened once, and only by the opposite direction
+	key, err := newAESKey()
+	assertNoErr(err, t)
+	sender, err := newDatagramSession(key)
+	assertNoErr(err, t)
+	receiver, err := newDatagramSession(key)
+	assertNoErr(err, t)
+	assertEq(sender.id, receiver.id, t)
+	datagram, err := sender.seal(datagramFromClient, datagramData, []byte("Hello, datagram!"))
+	assertNoErr(err, t)
+	_, _, err = receiver.open(datagramFromServer, datagram)
+	assertNe(err, nil, t)
+	kind, payload, err := receiver.open(datagramFromClient, datagram)
+	assertNoErr(err, t)
+	assertEq(kind, datagramData, t)
+	assertEq(string(payload), "Hello, datagram!", t)
+	_, _, err = receiver.open(datagramFromClient, datagram)
+	assertNe(err, nil, t)
+}
+
+// Test sending unreliable messages between server and client
+func TestUnreliable(t *testing.T) {
+	// Create server
+	server, serverEvent := NewServer[int, string]()
+	err := server.SetUnreliable(true)
+	assertNoErr(err, t)
+
+	// Start server
+	err = server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	assert(server.Serving(), t, "Server should be serving")
+	time.Sleep(waitTime)
+
+	// Check server address info
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Create client
+	client, clientEvent := NewClient[string, int]()
+	err = client.SetUnreliable(true)
+	assertNoErr(err, t)
+
+	// Connect to server
+	err = client.Connect(host, port)
+	assertNoErr(err, t)
+	assert(client.Connected(), t, "Client should be connected")
+	time.Sleep(waitTime)
+
+	// Check connect event was received
+	clientConnectEvent := <-serverEvent
+	assertEq(clientConnectEvent, ServerEvent[string]{
+		EventType: ServerConnect,
+		ClientID:  0,
+		Metadata:  newMetadata(),
+	}, t)
+
+	// Send unreliable message to server
+	messageFromClient := "Hello, unreliable server!"
+	err = client.SendUnreliable(messageFromClient)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+
+	// Receive unreliable message from client
+	serverReceiveEvent := <-serverEvent
+	assertEq(serverReceiveEvent, ServerEvent[string]{
+		EventType:  ServerReceive,
+		ClientID:   0,
+		Data:       messageFromClient,
+		Unreliable: true,
+		Metadata:   newMetadata(),
+	}, t)
+
+	// Send unreliable message to client
+	err = server.SendUnreliable(len(serverReceiveEvent.Data))
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+
+	// Receive unreliable message from server
+	clientReceiveEvent := <-clientEvent
+	assertEq(clientReceiveEvent, ClientEvent[int]{
+		EventType:  ClientReceive,
+		Data:       len(messageFromClient),
+		Unreliable: true,
+	}, t)
+
+	// Reliable messages are still delivered as before
+	err = server.Send(29275)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientReceiveEvent = <-clientEvent
+	assertEq(clientReceiveEvent, ClientEvent[int]{
+		EventType: ClientReceive,
+		Data:      29275,
+	}, t)
+
+	// Disconnect from server
+	err = client.Disconnect()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+
+	// Check disconnect event was received
+	clientDisconnectEvent := <-serverEvent
+	assertEq(clientDisconnectEvent, ServerEvent[string]{
+		EventType: ServerDisconnect,
+		ClientID:  0,
+		Metadata:  newMetadata(),
+	}, t)
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	assert(!server.Serving(), t, "Server should not be serving")
+	time.Sleep(waitTime)
+}
+
+// Test negotiating and registering the datagram channel
+func TestDatagramRegistration(t *testing.T) {
+	// Create a server without unreliable messages
+	server, _ := NewServer[string, string]()
+	err := server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Clients that require unreliable messages cannot connect
+	client, _ := NewClient[string, string]()
+	err = client.SetUnreliable(true)
+	assertNoErr(err, t)
+	err = client.Connect(host, port)
+	assert(errors.Is(err, ErrIncompatiblePeer), t, "Server should not support unreliable messages")
+	assert(!client.Connected(), t, "Client should not be connected")
+	err = server.Stop()
+	assertNoErr(err, t)
+
+	// Create the two ends of a datagram channel
+	key, err := newAESKey()
+	assertNoErr(err, t)
+	serverSession, err := newDatagramSession(key)
+	assertNoErr(err, t)
+	clientSession, err := newDatagramSession(key)
+	assertNoErr(err, t)
+	serverSock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assertNoErr(err, t)
+	defer serverSock.Close()
+	clientSock, err := net.DialUDP("udp", nil, serverSock.LocalAddr().(*net.UDPAddr))
+	assertNoErr(err, t)
+	defer clientSock.Close()
+
+	// Registration is sent again when it is lost
+	go func() {
+		buffer := make([]byte, maxDatagramSize)
+		for i := 0; i < 2; i++ {
+			n, addr, err := serverSock.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			kind, _, err := serverSession.open(datagramFromClient, buffer[:n])
+			if err != nil || kind != datagramRegister || i == 0 {
+				continue
+			}
+			ack, err := serverSession.seal(datagramFromServer, datagramRegister, []byte{})
+			if err == nil {
+				serverSock.WriteToUDP(ack, addr)
+			}
+		}
+	}()
+	start := time.Now()
+	err = registerDatagrams(clientSock, clientSession)
+	assertNoErr(err, t)
+	assert(time.Since(start) >= datagramRegisterInterval, t, "Registration should be sent again")
+
+	// Registration fails when it is never acknowledged
+	start = time.Now()
+	err = registerDatagrams(clientSock, clientSession)
+	assertNe(err, nil, t)
+	assert(time.Since(start) >= datagramRegisterAttempts*datagramRegisterInterval, t, "Registration should be retried")
+}
+
+// Test sending unreliable messages while the client disconnects and the server stops
+func TestUnreliableShutdown(t *testing.T) {
+	// Create server
+	server, serverEvent := NewServer[string, string]()
+	err := server.SetUnreliable(true)
+	assertNoErr(err, t)
+
+	// Start server
+	err = server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Send from each side until sending fails, pausing between messages so as not to flood the datagram channel
+	sendUntilFailed := func(send func() error) <-chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for send() == nil {
+				time.Sleep(time.Millisecond)
+			}
+		}()
+		return done
+	}
+
+	// Connect to server
+	client, _ := NewClient[string, string]()
+	err = client.SetUnreliable(true)
+	assertNoErr(err, t)
+	err = client.Connect(host, port)
+	assertNoErr(err, t)
+	clientConnectEvent := <-serverEvent
+	assertEq(clientConnectEvent.EventType, ServerConnect, t)
+
+	// Disconnect while the client is sending
+	clientSending := sendUntilFailed(func() error { return client.SendUnreliable("Hello, server!") })
+	time.Sleep(waitTime / 10)
+	err = client.Disconnect()
+	assertNoErr(err, t)
+	<-clientSending
+
+	// Connect another client
+	otherClient, _ := NewClient[string, string]()
+	err = otherClient.SetUnreliable(true)
+	assertNoErr(err, t)
+	err = otherClient.Connect(host, port)
+	assertNoErr(err, t)
+
+	// Stop the server while it is sending
+	serverSending := sendUntilFailed(func() error { return server.SendUnreliable("Hello, client!") })
+	time.Sleep(waitTime / 10)
+	err = server.Stop()
+	assertNoErr(err, t)
+	<-serverSending
+	time.Sleep(waitTime)
+}
+
+// Test encoding and decoding frames
+func TestFrames(t *testing.T) {
+	// Data frames carry no ID by default
+	frame, err := encodeFrame(frameHeader{kind: frameData}, []byte("Hello, frame!"), false, 0)
+	assertNoErr(err, t)
+	assertEq(frame, append([]byte{byte(frameData), 0}, []byte("Hello, frame!")...), t)
+	header, data, err := decodeFrame(frame, defaultMaxMessageSize)
+	assertNoErr(err, t)
+	assertEq(header, frameHeader{kind: frameData}, t)
+	assertEq(string(data), "Hello, frame!", t)
+
+	// A non-zero ID is carried in the header
+	frame, err = encodeFrame(frameHeader{kind: frameAck, id: 29275}, []byte{}, false, 0)
+	assertNoErr(err, t)
+	assertEq(len(frame), frameHeaderSize+frameIDSize, t)
+	header, data, err = decodeFrame(frame, defaultMaxMessageSize)
+	assertNoErr(err, t)
+	assertEq(header, frameHeader{kind: frameAck, flags: flagID, id: 29275}, t)
+	assertEq(len(data), 0, t)
+
+	// Truncated frames are rejected
+	_, _, err = decodeFrame([]byte{byte(frameData)}, defaultMaxMessageSize)
+	assertNe(err, nil, t)
+	_, _, err = decodeFrame([]byte{byte(frameData), flagID, 0, 0}, defaultMaxMessageSize)
+	assertNe(err, nil, t)
+}
+
+// Test message compression
+func TestCompression(t *testing.T) {
+	// Compressible data meeting the threshold is compressed
+	data := []byte(strings.Repeat("Hello, compression! ", 100))
+	frame, err := encodeFrame(frameHeader{kind: frameData}, data, true, 64)
+	assertNoErr(err, t)
+	assert(len(frame) < len(data), t, "Frame should be compressed")
+	header, decoded, err := decodeFrame(frame, defaultMaxMessageSize)
+	assertNoErr(err, t)
+	assertEq(header, frameHeader{kind: frameData, flags: flagCompressed}, t)
+	assertEq(decoded, data, t)
+
+	// Data below the threshold is not compressed
+	frame, err = encodeFrame(frameHeader{kind: frameData}, data[:32], true, 64)
+	assertNoErr(err, t)
+	header, decoded, err = decodeFrame(frame, defaultMaxMessageSize)
+	assertNoErr(err, t)
+	assertEq(header, frameHeader{kind: frameData}, t)
+	assertEq(decoded, data[:32], t)
+
+	// Create server
+	server, serverEvent := NewServer[string, string]()
+	err = server.SetCompression(true, 64)
+	assertNoErr(err, t)
+
+	// Start server
+	err = server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Connect a client with compression enabled
+	client1, clientEvent1 := NewClient[string, string]()
+	err = client1.SetCompression(true, 64)
+	assertNoErr(err, t)
+	err = client1.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	assert(client1.settings.capabilities.Has(CapabilityCompression), t, "Compression should be negotiated")
+	<-serverEvent
+
+	// Connect a client with compression disabled
+	client2, clientEvent2 := NewClient[string, string]()
+	err = client2.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	assert(!client2.settings.capabilities.Has(CapabilityCompression), t, "Compression should not be negotiated")
+	<-serverEvent
+	assert(server.clients[0].settings.capabilities.Has(CapabilityCompression), t, "Compression should be negotiated")
+	assert(!server.clients[1].settings.capabilities.Has(CapabilityCompression), t, "Compression should not be negotiated")
+
+	// Send a compressible message from the client
+	messageFromClient := strings.Repeat("Hello, server! ", 100)
+	err = client1.Send(messageFromClient)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	serverReceiveEvent := <-serverEvent
+	assertEq(serverReceiveEvent, ServerEvent[string]{
+		EventType: ServerReceive,
+		ClientID:  0,
+		Data:      messageFromClient,
+		Metadata:  newMetadata(),
+	}, t)
+
+	// Send a compressible message to both clients
+	messageFromServer := strings.Repeat("Hello, clients! ", 100)
+	err = server.Send(messageFromServer)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientReceiveEvent1 := <-clientEvent1
+	assertEq(clientReceiveEvent1, ClientEvent[string]{
+		EventType: ClientReceive,
+		Data:      messageFromServer,
+	}, t)
+	clientReceiveEvent2 := <-clientEvent2
+	assertEq(clientReceiveEvent2, ClientEvent[string]{
+		EventType: ClientReceive,
+		Data:      messageFromServer,
+	}, t)
+
+	// Disconnect from server
+	err = client1.Disconnect()
+	assertNoErr(err, t)
+	err = client2.Disconnect()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	<-serverEvent
+	<-serverEvent
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// Test protocol version and capability negotiation
+func TestProtocolNegotiation(t *testing.T) {
+	serverConfig := newProtocolConfig()
+	serverConfig.codecs = []Codec{CodecJSON, CodecGob}
+	serverConfig.heartbeat = 2 * time.Second
+	clientConfig := newProtocolConfig()
+	clientConfig.codecs = []Codec{CodecGob}
+	clientConfig.compression = true
+	clientConfig.heartbeat = time.Second
+
+	// Negotiate the best common settings
+	choice, err := clientConfig.negotiate(serverConfig.hello(rsa.PublicKey{}))
+	assertNoErr(err, t)
+	assertEq(choice, clientHello{
+		Version:           protocolVersion,
+		Capabilities:      CapabilityAEAD | CapabilityHeartbeat | CapabilityHeaders,
+		Codec:             CodecGob,
+		HeartbeatInterval: 2 * time.Second,
+	}, t)
+	settings, err := serverConfig.accept(choice)
+	assertNoErr(err, t)
+	assertEq(settings, choice.settings(), t)
+
+	// Fail when no protocol version is shared
+	hello := serverConfig.hello(rsa.PublicKey{})
+	hello.Versions = []uint{protocolVersion + 1}
+	_, err = clientConfig.negotiate(hello)
+	assert(errors.Is(err, ErrIncompatiblePeer), t, "Peer should be incompatible")
+
+	// Fail when no codec is shared
+	hello = serverConfig.hello(rsa.PublicKey{})
+	hello.Codecs = []Codec{CodecJSON}
+	_, err = clientConfig.negotiate(hello)
+	assert(errors.Is(err, ErrIncompatiblePeer), t, "Peer should be incompatible")
+
+	// Reject choices the server does not support
+	_, err = serverConfig.accept(clientHello{
+		Version:      protocolVersion,
+		Capabilities: CapabilityAEAD | CapabilityCompression,
+		Codec:        CodecJSON,
+	})
+	assertNe(err, nil, t)
+
+	// Require authenticated encryption on both sides
+	_, err = serverConfig.accept(clientHello{
+		Version:      protocolVersion,
+		Capabilities: CapabilityHeaders,
+		Codec:        CodecJSON,
+	})
+	assertNe(err, nil, t)
+	hello = serverConfig.hello(rsa.PublicKey{})
+	hello.Capabilities &^= CapabilityAEAD
+	_, err = clientConfig.negotiate(hello)
+	assert(errors.Is(err, ErrIncompatiblePeer), t, "Peer should be incompatible")
+
+	// Create server
+	server, serverEvent := NewServer[string, string]()
+	err = server.SetCodecs(CodecGob)
+	assertNoErr(err, t)
+	err = server.SetHeartbeat(50 * time.Millisecond)
+	assertNoErr(err, t)
+
+	// Start server
+	err = server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Connect a client that shares no codec with the server
+	client1, _ := NewClient[string, string]()
+	err = client1.Connect(host, port)
+	assert(errors.Is(err, ErrIncompatiblePeer), t, "Peer should be incompatible")
+	assert(!client1.Connected(), t, "Client should not be connected")
+
+	// Connect a compatible client
+	client2, clientEvent2 := NewClient[string, string]()
+	err = client2.SetCodecs(CodecJSON, CodecGob)
+	assertNoErr(err, t)
+	err = client2.SetHeartbeat(50 * time.Millisecond)
+	assertNoErr(err, t)
+	err = client2.Connect(host, port)
+	assertNoErr(err, t)
+	assert(client2.Connected(), t, "Client should be connected")
+	assertEq(client2.settings.codec, CodecGob, t)
+	assert(client2.settings.capabilities.Has(CapabilityAEAD|CapabilityHeartbeat), t, "Capabilities should be negotiated")
+
+	// Check connect event was received
+	clientConnectEvent := <-serverEvent
+	assertEq(clientConnectEvent, ServerEvent[string]{
+		EventType: ServerConnect,
+		ClientID:  1,
+		Metadata:  newMetadata(),
+	}, t)
+
+	// Heartbeats keep an idle connection alive
+	time.Sleep(5 * waitTime)
+	assert(client2.Connected(), t, "Client should be connected")
+
+	// Messages are exchanged using the negotiated codec
+	err = client2.Send("Hello, gob!")
+	assertNoErr(err, t)
+	serverReceiveEvent := <-serverEvent
+	assertEq(serverReceiveEvent, ServerEvent[string]{
+		EventType: ServerReceive,
+		ClientID:  1,
+		Data:      "Hello, gob!",
+		Metadata:  newMetadata(),
+	}, t)
+	err = server.Send("Hello, client!")
+	assertNoErr(err, t)
+	clientReceiveEvent := <-clientEvent2
+	assertEq(clientReceiveEvent, ClientEvent[string]{
+		EventType: ClientReceive,
+		Data:      "Hello, client!",
+	}, t)
+
+	// Disconnect from server
+	err = client2.Disconnect()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	<-serverEvent
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// Test multiplexing streams over a connection
+func TestStreams(t *testing.T) {
+	// Create server
+	server, serverEvent := NewServer[string, string]()
+
+	// Start server
+	err := server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Connect to server
+	client, clientEvent := NewClient[string, string]()
+	err = client.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientConnectEvent := <-serverEvent
+	assertEq(clientConnectEvent.EventType, ServerConnect, t)
+
+	// Generate data larger than the stream window
+	streamData := make([]byte, 4*streamWindowSize+rand.Int()%streamWindowSize)
+	_, err = cryptorand.Read(streamData)
+	assertNoErr(err, t)
+
+	// Open a stream from the client and write to it in the background
+	clientStream, err := client.OpenStream()
+	assertNoErr(err, t)
+	assertEq(clientStream.ID()%2, uint64(1), t)
+	writeErr := make(chan error)
+	go func() {
+		_, err := clientStream.Write(streamData)
+		if err == nil {
+			err = clientStream.Close()
+		}
+		writeErr <- err
+	}()
+
+	// Messages are delivered while the stream is being written
+	err = client.Send("Hello, server!")
+	assertNoErr(err, t)
+
+	// Receive the stream and the message
+	serverStreamEvent := <-serverEvent
+	assertEq(serverStreamEvent.EventType, ServerStream, t)
+	assertEq(serverStreamEvent.Stream.ID(), clientStream.ID(), t)
+	serverReceiveEvent := <-serverEvent
+	assertEq(serverReceiveEvent, ServerEvent[string]{
+		EventType: ServerReceive,
+		ClientID:  0,
+		Data:      "Hello, server!",
+		Metadata:  newMetadata(),
+	}, t)
+
+	// Read the stream until the client closes it
+	received, err := io.ReadAll(serverStreamEvent.Stream)
+	assertNoErr(err, t)
+	assertNoErr(<-writeErr, t)
+	assertEq(received, streamData, t)
+	err = serverStreamEvent.Stream.Close()
+	assertNoErr(err, t)
+
+	// Open a stream from the server
+	serverStream, err := server.OpenStream(0)
+	assertNoErr(err, t)
+	assertEq(serverStream.ID()%2, uint64(0), t)
+	_, err = serverStream.Write([]byte("Hello, stream!"))
+	assertNoErr(err, t)
+	err = serverStream.Close()
+	assertNoErr(err, t)
+	_, err = serverStream.Write([]byte("Too late"))
+	assertEq(err, io.ErrClosedPipe, t)
+
+	// Receive the stream on the client
+	clientStreamEvent := <-clientEvent
+	assertEq(clientStreamEvent.EventType, ClientStream, t)
+	received, err = io.ReadAll(clientStreamEvent.Stream)
+	assertNoErr(err, t)
+	assertEq(string(received), "Hello, stream!", t)
+
+	// Open streams fail once the connection closes
+	openStream, err := client.OpenStream()
+	assertNoErr(err, t)
+	err = client.Disconnect()
+	assertNoErr(err, t)
+	_, err = openStream.Read(make([]byte, 1))
+	assertNe(err, nil, t)
+	time.Sleep(waitTime)
+	<-serverEvent
+	clientDisconnectEvent := <-serverEvent
+	assertEq(clientDisconnectEvent, ServerEvent[string]{
+		EventType: ServerDisconnect,
+		ClientID:  0,
+		Metadata:  newMetadata(),
+	}, t)
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// Test limiting the number of streams a client can have open
+func TestStreamLimit(t *testing.T) {
+	// Create server
+	server, serverEvent := NewServer[string, string]()
+	err := server.SetMaxStreams(2)
+	assertNoErr(err, t)
+
+	// Start server
+	err = server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+	err = server.SetMaxStreams(4)
+	assertNe(err, nil, t)
+
+	// Connect to server
+	client, clientEvent := NewClient[string, string]()
+	err = client.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientConnectEvent := <-serverEvent
+	assertEq(clientConnectEvent.EventType, ServerConnect, t)
+
+	// Streams the client has closed stop counting once the server reads them to EOF, even if the server never closes them
+	for i := 0; i < 4; i++ {
+		err = client.SendStream(strings.NewReader("Hello, limited server!"))
+		assertNoErr(err, t)
+		sentStreamEvent := <-serverEvent
+		assertEq(sentStreamEvent.EventType, ServerStream, t)
+		received, err := io.ReadAll(sentStreamEvent.Stream)
+		assertNoErr(err, t)
+		assertEq(string(received), "Hello, limited server!", t)
+	}
+
+	// Open streams up to the limit
+	firstStream, err := client.OpenStream()
+	assertNoErr(err, t)
+	_, err = client.OpenStream()
+	assertNoErr(err, t)
+	firstStreamEvent := <-serverEvent
+	assertEq(firstStreamEvent.EventType, ServerStream, t)
+	secondStreamEvent := <-serverEvent
+	assertEq(secondStreamEvent.EventType, ServerStream, t)
+
+	// Closing a stream on both sides frees its place
+	err = firstStream.Close()
+	assertNoErr(err, t)
+	_, err = io.ReadAll(firstStreamEvent.Stream)
+	assertNoErr(err, t)
+	err = firstStreamEvent.Stream.Close()
+	assertNoErr(err, t)
+	_, err = client.OpenStream()
+	assertNoErr(err, t)
+	thirdStreamEvent := <-serverEvent
+	assertEq(thirdStreamEvent.EventType, ServerStream, t)
+
+	// Opening a stream past the limit disconnects the client
+	_, err = client.OpenStream()
+	assertNoErr(err, t)
+	clientDisconnectEvent := <-serverEvent
+	assertEq(clientDisconnectEvent.EventType, ServerDisconnect, t)
+	assertEq(clientDisconnectEvent.Err, ErrTooManyStreams, t)
+	disconnectedEvent := <-clientEvent
+	assertEq(disconnectedEvent.EventType, ClientDisconnected, t)
+	assert(errors.Is(disconnectedEvent.Err, ErrConnectionClosed), t, "Client should be told why it was disconnected")
+	assert(strings.Contains(disconnectedEvent.Err.Error(), ErrTooManyStreams.Error()), t, "Client should be told why it was disconnected")
+	_, err = secondStreamEvent.Stream.Read(make([]byte, 1))
+	assertNe(err, nil, t)
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// Test streaming data larger than is sensible to send as a single message
+func TestSendStream(t *testing.T) {
+	// Create server
+	server, serverEvent := NewServer[any, any]()
+
+	// Start server
+	err := server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Connect to server
+	client, clientEvent := NewClient[any, any]()
+	err = client.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientConnectEvent := <-serverEvent
+	assertEq(clientConnectEvent.EventType, ServerConnect, t)
+
+	// Stream generated data to the server without holding it in memory
+	streamSize := int64(32*1024*1024 + rand.Int()%streamChunkSize)
+	seed := rand.Int63()
+	sentHash := sha256.New()
+	reader := io.TeeReader(io.LimitReader(rand.New(rand.NewSource(seed)), streamSize), sentHash)
+	sendErr := make(chan error)
+	go func() {
+		sendErr <- client.SendStream(reader)
+	}()
+
+	// Receive and hash the stream on the server
+	serverStreamEvent := <-serverEvent
+	assertEq(serverStreamEvent.EventType, ServerStream, t)
+	receivedHash := sha256.New()
+	n, err := io.Copy(receivedHash, serverStreamEvent.Stream)
+	assertNoErr(err, t)
+	assertNoErr(<-sendErr, t)
+	assertEq(n, streamSize, t)
+	assertEq(receivedHash.Sum(nil), sentHash.Sum(nil), t)
+
+	// Stream a small message to the client
+	err = server.SendStream(strings.NewReader("Hello, streaming client!"), 0)
+	assertNoErr(err, t)
+	clientStreamEvent := <-clientEvent
+	assertEq(clientStreamEvent.EventType, ClientStream, t)
+	received, err := io.ReadAll(clientStreamEvent.Stream)
+	assertNoErr(err, t)
+	assertEq(string(received), "Hello, streaming client!", t)
+
+	// Disconnect from server
+	err = client.Disconnect()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientDisconnectEvent := <-serverEvent
+	assertEq(clientDisconnectEvent.EventType, ServerDisconnect, t)
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// Test transferring files, including resuming and rejecting transfers
+func TestFileTransfer(t *testing.T) {
+	// Create a file to send
+	dir := t.TempDir()
+	sourcePath := filepath.Join(dir, "source.bin")
+	fileData := make([]byte, 3*fileProgressInterval+rand.Int()%fileProgressInterval)
+	_, err := cryptorand.Read(fileData)
+	assertNoErr(err, t)
+	err = os.WriteFile(sourcePath, fileData, 0644)
+	assertNoErr(err, t)
+
+	// Create server
+	server, serverEvent := NewServer[any, any]()
+
+	// Start server
+	err = server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Connect to server
+	client, clientEvent := NewClient[any, any]()
+	err = client.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientConnectEvent := <-serverEvent
+	assertEq(clientConnectEvent.EventType, ServerConnect, t)
+
+	// Receive events for a transfer until it completes, returning the number of progress events
+	awaitServerTransfer := func() int {
+		progressEvents := 0
+		for event := range serverEvent {
+			if event.EventType == ServerFileProgress {
+				progressEvents++
+			} else {
+				assertEq(event.EventType, ServerFileComplete, t)
+				assertNoErr(event.File.Err(), t)
+				return progressEvents
+			}
+		}
+		return progressEvents
+	}
+	awaitClientTransfer := func() {
+		for event := range clientEvent {
+			if event.EventType != ClientFileProgress {
+				assertEq(event.EventType, ClientFileComplete, t)
+				return
+			}
+		}
+	}
+
+	// Offer the file to the server
+	transfer, err := client.SendFile(sourcePath)
+	assertNoErr(err, t)
+	offerEvent := <-serverEvent
+	assertEq(offerEvent.EventType, ServerFileOffer, t)
+	assertEq(offerEvent.File.ID, transfer.ID, t)
+	assertEq(offerEvent.File.Name, "source.bin", t)
+	assertEq(offerEvent.File.Size, int64(len(fileData)), t)
+
+	// Accept the file and wait for it to be received
+	destPath := filepath.Join(dir, "dest.bin")
+	err = offerEvent.File.Accept(destPath)
+	assertNoErr(err, t)
+	assert(awaitServerTransfer() >= 3, t, "Progress should be reported")
+	awaitClientTransfer()
+	assertNoErr(transfer.Wait(), t)
+	received, err := os.ReadFile(destPath)
+	assertNoErr(err, t)
+	assertEq(received, fileData, t)
+	_, err = os.Stat(destPath + partialFileSuffix)
+	assert(os.IsNotExist(err), t, "Partial file should be removed")
+
+	// Resume a transfer that was interrupted part way through
+	resumePath := filepath.Join(dir, "resume.bin")
+	resumeOffset := int64(fileProgressInterval + rand.Int()%fileProgressInterval)
+	err = os.WriteFile(resumePath+partialFileSuffix, fileData[:resumeOffset], 0644)
+	assertNoErr(err, t)
+	transfer, err = client.SendFile(sourcePath)
+	assertNoErr(err, t)
+	offerEvent = <-serverEvent
+	assertEq(offerEvent.EventType, ServerFileOffer, t)
+	err = offerEvent.File.Accept(resumePath)
+	assertNoErr(err, t)
+	awaitServerTransfer()
+	awaitClientTransfer()
+	assertNoErr(transfer.Wait(), t)
+	assertEq(transfer.Offset(), resumeOffset, t)
+	assertEq(offerEvent.File.Offset(), resumeOffset, t)
+	received, err = os.ReadFile(resumePath)
+	assertNoErr(err, t)
+	assertEq(received, fileData, t)
+
+	// Reject a transfer
+	transfer, err = server.SendFile(sourcePath, 0)
+	assertNoErr(err, t)
+	clientOfferEvent := <-clientEvent
+	assertEq(clientOfferEvent.EventType, ClientFileOffer, t)
+	err = clientOfferEvent.File.Reject("no thanks")
+	assertNoErr(err, t)
+	err = clientOfferEvent.File.Accept(destPath)
+	assertNe(err, nil, t)
+	err = transfer.Wait()
+	assert(errors.Is(err, ErrFileRejected), t, "Transfer should be rejected")
+
+	// Disconnect from server
+	err = client.Disconnect()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	for event := range serverEvent {
+		if event.EventType == ServerDisconnect {
+			break
+		}
+	}
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// Test refusing file offers with names that escape the directory they are saved to
+func TestFileOfferNames(t *testing.T) {
+	// Check file names
+	assert(validFileName("file.txt"), t, "Plain name should be valid")
+	assert(validFileName("..file"), t, "Name starting with dots should be valid")
+	for _, name := range []string{"", ".", "..", "../file.txt", "../../.ssh/authorized_keys", "dir/file.txt", "/etc/passwd", `..\file.txt`} {
+		assert(!validFileName(name), t, "Name should be invalid: "+name)
+	}
+
+	// Create server
+	server, serverEvent := NewServer[string, string]()
+
+	// Start server
+	err := server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Connect to server
+	client, _ := NewClient[string, string]()
+	err = client.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientConnectEvent := <-serverEvent
+	assertEq(clientConnectEvent.EventType, ServerConnect, t)
+
+	// Offer a file with a malicious name
+	stream, err := client.streams.open(streamFile)
+	assertNoErr(err, t)
+	offer := fileOffer{Name: "../../.ssh/authorized_keys", Size: 4, Hash: "0000"}
+	offer.ID = transferID(offer)
+	err = writeTransferMessage(stream, offer)
+	assertNoErr(err, t)
+
+	// The offer is refused without being reported
+	answer := fileAnswer{}
+	err = readTransferMessage(stream, &answer)
+	assertNoErr(err, t)
+	assert(!answer.Accepted, t, "Malicious offer should be refused")
+	assertEq(answer.Reason, "invalid file name", t)
+	select {
+	case event := <-serverEvent:
+		t.Errorf("Unexpected event: %+v", event)
+	case <-time.After(waitTime):
+	}
+
+	// Disconnect from server
+	err = client.Disconnect()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientDisconnectEvent := <-serverEvent
+	assertEq(clientDisconnectEvent.EventType, ServerDisconnect, t)
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// Test completing file transfers that are rejected while events are backed up, or that are never answered
+func TestFileTransferCompletion(t *testing.T) {
+	// Create a file to send
+	dir := t.TempDir()
+	sourcePath := filepath.Join(dir, "source.bin")
+	err := os.WriteFile(sourcePath, []byte("Hello, file!"), 0644)
+	assertNoErr(err, t)
+
+	// Create server
+	server, serverEvent := NewServer[string, string]()
+
+	// Start server
+	err = server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Connect to server
+	client, clientEvent := NewClient[string, string]()
+	err = client.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientConnectEvent := <-serverEvent
+	assertEq(clientConnectEvent.EventType, ServerConnect, t)
+
+	// Offer a file to the client, then fill the client's event channel
+	transfer, err := server.SendFile(sourcePath, 0)
+	assertNoErr(err, t)
+	clientOfferEvent := <-clientEvent
+	assertEq(clientOfferEvent.EventType, ClientFileOffer, t)
+	for i := 0; i < channelBufferSize; i++ {
+		err = server.Send("Hello, busy client!", 0)
+		assertNoErr(err, t)
+	}
+	for len(clientEvent) < channelBufferSize {
+		time.Sleep(waitTime / 10)
+	}
+
+	// Rejecting the file does not wait for room in the event channel
+	rejected := make(chan error)
+	go func() {
+		rejected <- clientOfferEvent.File.Reject("too busy")
+	}()
+	select {
+	case err = <-rejected:
+		assertNoErr(err, t)
+	case <-time.After(10 * waitTime):
+		t.Fatal("Rejecting a file should not wait for events to be received")
+	}
+	err = transfer.Wait()
+	assert(errors.Is(err, ErrFileRejected), t, "Transfer should be rejected")
+	for i := 0; i < channelBufferSize; i++ {
+		clientReceiveEvent := <-clientEvent
+		assertEq(clientReceiveEvent.EventType, ClientReceive, t)
+	}
+	clientCompleteEvent := <-clientEvent
+	assertEq(clientCompleteEvent.EventType, ClientFileComplete, t)
+	assert(errors.Is(clientCompleteEvent.File.Err(), ErrFileRejected), t, "Transfer should be rejected")
+	serverCompleteEvent := <-serverEvent
+	assertEq(serverCompleteEvent.EventType, ServerFileComplete, t)
+
+	// Offer another file to the client, then disconnect it before it answers
+	transfer, err = server.SendFile(sourcePath, 0)
+	assertNoErr(err, t)
+	clientOfferEvent = <-clientEvent
+	assertEq(clientOfferEvent.EventType, ClientFileOffer, t)
+	err = server.RemoveClient(0)
+	assertNoErr(err, t)
+
+	// Both sides of the transfer complete with an error
+	assertNe(transfer.Wait(), nil, t)
+	assertNe(clientOfferEvent.File.Wait(), nil, t)
+	err = clientOfferEvent.File.Accept(filepath.Join(dir, "dest.bin"))
+	assertNe(err, nil, t)
+	completed, disconnected := false, false
+	for !completed || !disconnected {
+		event := <-clientEvent
+		switch event.EventType {
+		case ClientFileComplete:
+			assertEq(event.File, clientOfferEvent.File, t)
+			completed = true
+		case ClientDisconnected:
+			disconnected = true
+		default:
+			t.Fatalf("Unexpected event: %+v", event)
+		}
+	}
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// Test sending byte slices without encoding them
+func TestRawMessages(t *testing.T) {
+	// Encode and decode byte slices as-is
+	message := []byte{0, 1, 2, 253, 254, 255}
+	encoded, err := encodeObjectCodec(message, CodecRaw)
+	assertNoErr(err, t)
+	assertEq(encoded, message, t)
+	decoded, err := decodeObjectCodec[[]byte](encoded, CodecRaw)
+	assertNoErr(err, t)
+	assertEq(decoded, message, t)
+
+	// Fail to use the raw codec with other types
+	_, err = encodeObjectCodec("Hello", CodecRaw)
+	assertNe(err, nil, t)
+	_, err = decodeObjectCodec[string](encoded, CodecRaw)
+	assertNe(err, nil, t)
+	typedServer, _ := NewServer[string, []byte]()
+	err = typedServer.SetCodecs(CodecRaw)
+	assertNe(err, nil, t)
+	typedClient, _ := NewClient[[]byte, string]()
+	err = typedClient.SetCodecs(CodecRaw)
+	assertNe(err, nil, t)
+
+	// Create server
+	server, serverEvent := NewRawServer()
+
+	// Start server
+	err = server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Connect a raw client
+	client1, clientEvent1 := NewRawClient()
+	err = client1.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	assertEq(client1.settings.codec, CodecRaw, t)
+	clientConnectEvent := <-serverEvent
+	assertEq(clientConnectEvent.EventType, ServerConnect, t)
+
+	// Connect a client using the JSON codec
+	client2, clientEvent2 := NewClient[[]byte, []byte]()
+	err = client2.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	assertEq(client2.settings.codec, CodecJSON, t)
+	clientConnectEvent = <-serverEvent
+	assertEq(clientConnectEvent.EventType, ServerConnect, t)
+
+	// Send messages from both clients
+	err = client1.Send(message)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	serverReceiveEvent := <-serverEvent
+	assertEq(serverReceiveEvent.EventType, ServerReceive, t)
+	assertEq(serverReceiveEvent.ClientID, 0, t)
+	assertEq(serverReceiveEvent.Data, message, t)
+	err = client2.Send(message)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	serverReceiveEvent = <-serverEvent
+	assertEq(serverReceiveEvent.EventType, ServerReceive, t)
+	assertEq(serverReceiveEvent.ClientID, 1, t)
+	assertEq(serverReceiveEvent.Data, message, t)
+
+	// Send a message to both clients
+	err = server.Send(message)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientReceiveEvent1 := <-clientEvent1
+	assertEq(clientReceiveEvent1.EventType, ClientReceive, t)
+	assertEq(clientReceiveEvent1.Data, message, t)
+	clientReceiveEvent2 := <-clientEvent2
+	assertEq(clientReceiveEvent2.EventType, ClientReceive, t)
+	assertEq(clientReceiveEvent2.Data, message, t)
+
+	// Disconnect from server
+	err = client1.Disconnect()
+	assertNoErr(err, t)
+	err = client2.Disconnect()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// A registered message type used for testing
+type testPing struct {
+	N int
+}
+
+// A registered message type used for testing
+type testChat struct {
+	From string
+	Text string
+}
+
+// Test sending multiple message types with a type registry
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	err := Register[testPing](registry, "ping")
+	assertNoErr(err, t)
+	err = Register[testChat](registry, "chat")
+	assertNoErr(err, t)
+
+	// Fail to register a name or type twice, or an interface type
+	err = Register[testPing](registry, "chat")
+	assertNe(err, nil, t)
+	err = Register[*testPing](registry, "ping")
+	assertNe(err, nil, t)
+	err = Register[any](registry, "any")
+	assertNe(err, nil, t)
+	name, ok := registry.Name(testChat{})
+	assert(ok, t, "Type should be registered")
+	assertEq(name, "chat", t)
+
+	// Encode and decode registered types with each codec
+	for _, codec := range []Codec{CodecJSON, CodecGob} {
+		encoded, err := encodeData[any](testChat{"a", "b"}, codec, registry)
+		assertNoErr(err, t)
+		decoded, err := decodeData[any](encoded, codec, registry)
+		assertNoErr(err, t)
+		assertEq(decoded, any(testChat{"a", "b"}), t)
+	}
+
+	// Fail to encode unregistered types, or decode unknown types
+	_, err = encodeData[any]("Hello", CodecJSON, registry)
+	assertNe(err, nil, t)
+	unknownRegistry := NewRegistry()
+	err = Register[string](unknownRegistry, "string")
+	assertNoErr(err, t)
+	encoded, err := encodeData[any]("Hello", CodecJSON, unknownRegistry)
+	assertNoErr(err, t)
+	_, err = decodeData[any](encoded, CodecJSON, registry)
+	assert(errors.Is(err, ErrUnknownMessageType), t, "Message type should be unknown")
+	_, err = decodeData[testPing](encoded, CodecJSON, unknownRegistry)
+	assert(errors.Is(err, ErrUnknownMessageType), t, "Message type should be unknown")
+
+	// Create server
+	server, serverEvent := NewServer[any, any]()
+	err = server.SetRegistry(registry)
+	assertNoErr(err, t)
+
+	// Start server
+	err = server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Connect to server, with a registry that has an extra type
+	clientRegistry := NewRegistry()
+	err = Register[testPing](clientRegistry, "ping")
+	assertNoErr(err, t)
+	err = Register[testChat](clientRegistry, "chat")
+	assertNoErr(err, t)
+	err = Register[string](clientRegistry, "string")
+	assertNoErr(err, t)
+	client, clientEvent := NewClient[any, any]()
+	err = client.SetRegistry(clientRegistry)
+	assertNoErr(err, t)
+	err = client.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientConnectEvent := <-serverEvent
+	assertEq(clientConnectEvent.EventType, ServerConnect, t)
+
+	// Send each registered type to the server
+	err = client.Send(testPing{N: 1})
+	assertNoErr(err, t)
+	err = client.Send(testChat{From: "client", Text: "Hello, server!"})
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	serverReceiveEvent := <-serverEvent
+	assertEq(serverReceiveEvent.EventType, ServerReceive, t)
+	assertEq(serverReceiveEvent.Data, any(testPing{N: 1}), t)
+	serverReceiveEvent = <-serverEvent
+	assertEq(serverReceiveEvent.EventType, ServerReceive, t)
+	assertEq(serverReceiveEvent.Data, any(testChat{From: "client", Text: "Hello, server!"}), t)
+
+	// Send a type the server does not know
+	err = client.Send("Hello")
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	serverErrorEvent := <-serverEvent
+	assertEq(serverErrorEvent.EventType, ServerError, t)
+	assertEq(serverErrorEvent.ClientID, 0, t)
+	assert(errors.Is(serverErrorEvent.Err, ErrUnknownMessageType), t, "Message type should be unknown")
+
+	// Fail to send an unregistered type
+	err = server.Send(3.14)
+	assertNe(err, nil, t)
+
+	// Send a registered type to the client
+	err = server.Send(testChat{From: "server", Text: "Hello, client!"})
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientReceiveEvent := <-clientEvent
+	assertEq(clientReceiveEvent.EventType, ClientReceive, t)
+	chat, ok := clientReceiveEvent.Data.(testChat)
+	assert(ok, t, "Message should be a chat message")
+	assertEq(chat.Text, "Hello, client!", t)
+
+	// Disconnect from server
+	err = client.Disconnect()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// Test dispatching received messages to handlers
+func TestRouter(t *testing.T) {
+	registry := NewRegistry()
+	err := Register[testPing](registry, "ping")
+	assertNoErr(err, t)
+	err = Register[testChat](registry, "chat")
+	assertNoErr(err, t)
+	err = Register[string](registry, "string")
+	assertNoErr(err, t)
+
+	// Route pings and chats to handlers, passing everything through middleware
+	handled := make(chan string, channelBufferSize)
+	router := NewRouter[any]()
+	Handle(router, func(message Message[any], ping testPing) error {
+		handled <- fmt.Sprintf("ping %d from %d", ping.N, message.ClientID)
+		return nil
+	})
+	Handle(router, func(message Message[any], chat testChat) error {
+		return fmt.Errorf("chat is disabled")
+	})
+	router.Use(func(next Handler[any]) Handler[any] {
+		return func(message Message[any]) error {
+			handled <- "first " + message.Type
+			return next(message)
+		}
+	}, func(next Handler[any]) Handler[any] {
+		return func(message Message[any]) error {
+			handled <- "second " + message.Type
+			return next(message)
+		}
+	})
+
+	// Create server
+	server, serverEvent := NewServer[any, any]()
+	err = server.SetRegistry(registry)
+	assertNoErr(err, t)
+	err = server.SetRouter(router)
+	assertNoErr(err, t)
+
+	// Start server
+	err = server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Connect to server
+	client, clientEvent := NewClient[any, any]()
+	err = client.SetRegistry(registry)
+	assertNoErr(err, t)
+	err = client.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientConnectEvent := <-serverEvent
+	assertEq(clientConnectEvent.EventType, ServerConnect, t)
+
+	// Send a message with a handler
+	err = client.Send(testPing{N: 7})
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	assertEq(<-handled, "first ping", t)
+	assertEq(<-handled, "second ping", t)
+	assertEq(<-handled, "ping 7 from 0", t)
+
+	// Send a message whose handler fails
+	err = client.Send(testChat{Text: "Hello"})
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	assertEq(<-handled, "first chat", t)
+	assertEq(<-handled, "second chat", t)
+	serverErrorEvent := <-serverEvent
+	assertEq(serverErrorEvent.EventType, ServerError, t)
+	assertEq(serverErrorEvent.Err.Error(), "chat is disabled", t)
+
+	// Send a message with no handler and no fallback
+	err = client.Send("Hello")
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	serverReceiveEvent := <-serverEvent
+	assertEq(serverReceiveEvent.EventType, ServerReceive, t)
+	assertEq(serverReceiveEvent.Data, any("Hello"), t)
+	assertEq(len(handled), 0, t)
+
+	// Send a message with no handler to the fallback
+	router.Fallback(func(message Message[any]) error {
+		handled <- "fallback " + message.Type
+		return nil
+	})
+	err = client.Send("Hello")
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	assertEq(<-handled, "first string", t)
+	assertEq(<-handled, "second string", t)
+	assertEq(<-handled, "fallback string", t)
+	assertEq(len(serverEvent), 0, t)
+
+	// Receive messages as events on the client, which has no router
+	err = server.Send(testPing{N: 8})
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientReceiveEvent := <-clientEvent
+	assertEq(clientReceiveEvent.EventType, ClientReceive, t)
+	assertEq(clientReceiveEvent.Data, any(testPing{N: 8}), t)
+
+	// Disconnect from server
+	err = client.Disconnect()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// Test intercepting messages in both directions
+func TestInterceptors(t *testing.T) {
+	// Create server
+	server, serverEvent := NewServer[string, string]()
+	server.InterceptInbound(func(message Message[string], next Handler[string]) error {
+		if message.Data == "reject" {
+			return fmt.Errorf("rejected by server")
+		}
+		message.Data = strings.ToUpper(message.Data)
+		return next(message)
+	}, func(message Message[string], next Handler[string]) error {
+		message.Data += "!"
+		return next(message)
+	})
+	server.InterceptOutbound(func(message Message[string], next Handler[string]) error {
+		if message.Data == "reject" {
+			return fmt.Errorf("rejected by server")
+		}
+		message.Data = fmt.Sprintf("%s, client #%d", message.Data, message.ClientID)
+		return next(message)
+	})
+
+	// Start server
+	err := server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Connect to server
+	client1, clientEvent1 := NewClient[string, string]()
+	sent := make(chan string, channelBufferSize)
+	client1.InterceptOutbound(func(message Message[string], next Handler[string]) error {
+		sent <- message.Data
+		return next(message)
+	})
+	client1.InterceptInbound(func(message Message[string], next Handler[string]) error {
+		time.Sleep(waitTime)
+		return next(message)
+	})
+	err = client1.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientConnectEvent := <-serverEvent
+	assertEq(clientConnectEvent.EventType, ServerConnect, t)
+	client2, clientEvent2 := NewClient[string, string]()
+	err = client2.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientConnectEvent = <-serverEvent
+	assertEq(clientConnectEvent.EventType, ServerConnect, t)
+
+	// Transform messages received by the server
+	err = client1.Send("hello")
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	assertEq(<-sent, "hello", t)
+	serverReceiveEvent := <-serverEvent
+	assertEq(serverReceiveEvent.EventType, ServerReceive, t)
+	assertEq(serverReceiveEvent.Data, "HELLO!", t)
+
+	// Reject a message received by the server
+	err = client2.Send("reject")
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	serverErrorEvent := <-serverEvent
+	assertEq(serverErrorEvent.EventType, ServerError, t)
+	assertEq(serverErrorEvent.ClientID, 1, t)
+	assertEq(serverErrorEvent.Err.Error(), "rejected by server", t)
+
+	// Transform messages sent by the server for each client
+	err = server.Send("hi")
+	assertNoErr(err, t)
+	clientReceiveEvent2 := <-clientEvent2
+	assertEq(clientReceiveEvent2.EventType, ClientReceive, t)
+	assertEq(clientReceiveEvent2.Data, "hi, client #1", t)
+
+	// Delay messages received by a client
+	select {
+	case <-clientEvent1:
+		t.Fatal("Message should be delayed")
+	default:
+	}
+	time.Sleep(2 * waitTime)
+	clientReceiveEvent1 := <-clientEvent1
+	assertEq(clientReceiveEvent1.EventType, ClientReceive, t)
+	assertEq(clientReceiveEvent1.Data, "hi, client #0", t)
+
+	// Reject a message sent by the server
+	err = server.Send("reject", 0)
+	assertEq(err.Error(), "rejected by server", t)
+	time.Sleep(2 * waitTime)
+	assertEq(len(clientEvent1), 0, t)
+
+	// Disconnect from server
+	err = client1.Disconnect()
+	assertNoErr(err, t)
+	err = client2.Disconnect()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// A message type that validates itself, used for testing
+type testOrder struct {
+	Item     string
+	Quantity int
+}
+
+// Validate an order
+func (order testOrder) Validate() error {
+	if order.Quantity <= 0 {
+		return fmt.Errorf("quantity must be positive")
+	}
+
+	return nil
+}
+
+// Test validating received messages
+func TestValidation(t *testing.T) {
+	// Create server
+	server, serverEvent := NewServer[any, testOrder]()
+	err := server.SetValidation(ValidationSkip, func(order testOrder) error {
+		if order.Item == "" {
+			return fmt.Errorf("item is required")
+		}
+		return nil
+	})
+	assertNoErr(err, t)
+
+	// Start server
+	err = server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Connect to server
+	client, _ := NewClient[any, any]()
+	err = client.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientConnectEvent := <-serverEvent
+	assertEq(clientConnectEvent.EventType, ServerConnect, t)
+
+	// Send a message that cannot be decoded, and messages that fail each kind of validation
+	for _, message := range []any{"not an order", testOrder{Item: "apple"}, testOrder{Quantity: 1}} {
+		err = client.Send(message)
+		assertNoErr(err, t)
+		time.Sleep(waitTime)
+		serverErrorEvent := <-serverEvent
+		assertEq(serverErrorEvent.EventType, ServerError, t)
+		assert(errors.Is(serverErrorEvent.Err, ErrInvalidMessage), t, "Message should be invalid")
+	}
+
+	// Send a valid message over the same connection
+	err = client.Send(testOrder{Item: "apple", Quantity: 3})
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	serverReceiveEvent := <-serverEvent
+	assertEq(serverReceiveEvent.EventType, ServerReceive, t)
+	assertEq(serverReceiveEvent.Data, testOrder{Item: "apple", Quantity: 3}, t)
+
+	// Disconnect from server
+	err = client.Disconnect()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientDisconnectEvent := <-serverEvent
+	assertEq(clientDisconnectEvent.EventType, ServerDisconnect, t)
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+
+	// Create a server that disconnects clients sending invalid messages
+	server, serverEvent = NewServer[any, testOrder]()
+	err = server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err = server.GetAddr()
+	assertNoErr(err, t)
+	client, clientEvent := NewClient[any, any]()
+	err = client.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientConnectEvent = <-serverEvent
+	assertEq(clientConnectEvent.EventType, ServerConnect, t)
+
+	// Send an invalid message and get disconnected
+	err = client.Send(testOrder{Item: "apple"})
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	serverErrorEvent := <-serverEvent
+	assertEq(serverErrorEvent.EventType, ServerError, t)
+	assert(errors.Is(serverErrorEvent.Err, ErrInvalidMessage), t, "Message should be invalid")
+	clientDisconnectEvent = <-serverEvent
+	assertEq(clientDisconnectEvent.EventType, ServerDisconnect, t)
+	clientDisconnectedEvent := <-clientEvent
+	assertEq(clientDisconnectedEvent.EventType, ClientDisconnected, t)
+	assert(!client.Connected(), t, "Client should be disconnected")
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// Test filtering incoming connections
+func TestAcceptFilter(t *testing.T) {
+	// Allow and deny IP ranges
+	filter, err := NewIPFilter([]string{"10.0.0.0/8", "192.168.1.7", "fd00::/8"}, []string{"10.1.0.0/16"})
+	assertNoErr(err, t)
+	assert(filter.Allowed(netip.MustParseAddr("10.2.3.4")), t, "Address should be allowed")
+	assert(filter.Allowed(netip.MustParseAddr("::ffff:10.2.3.4")), t, "Address should be allowed")
+	assert(filter.Allowed(netip.MustParseAddr("192.168.1.7")), t, "Address should be allowed")
+	assert(filter.Allowed(netip.MustParseAddr("fd12::1")), t, "Address should be allowed")
+	assert(!filter.Allowed(netip.MustParseAddr("10.1.3.4")), t, "Address should be denied")
+	assert(!filter.Allowed(netip.MustParseAddr("192.168.1.8")), t, "Address should not be allowed")
+	assert(!filter.Allowed(netip.MustParseAddr("127.0.0.1")), t, "Address should not be allowed")
+	denyFilter, err := NewIPFilter(nil, []string{"127.0.0.0/8"})
+	assertNoErr(err, t)
+	assert(!denyFilter.Allowed(netip.MustParseAddr("127.0.0.1")), t, "Address should be denied")
+	assert(denyFilter.Allowed(netip.MustParseAddr("8.8.8.8")), t, "Address should be allowed")
+	_, err = NewIPFilter([]string{"not an IP"}, nil)
+	assertNe(err, nil, t)
+
+	// Create server
+	allowAll := false
+	var filterMutex sync.Mutex
+	server, serverEvent := NewServer[string, string]()
+	err = server.SetAcceptFilter(func(info ConnectionInfo) error {
+		filterMutex.Lock()
+		defer filterMutex.Unlock()
+
+		if allowAll {
+			return nil
+		}
+		return denyFilter.Accept(info)
+	})
+	assertNoErr(err, t)
+
+	// Start server
+	err = server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Connect from a denied address
+	client, _ := NewClient[string, string]()
+	err = client.Connect(host, port)
+	assert(errors.Is(err, ErrConnectionRejected), t, "Connection should be rejected")
+	assert(strings.Contains(err.Error(), "address not allowed"), t, "Reason should be sent")
+	assert(!client.Connected(), t, "Client should not be connected")
+	time.Sleep(waitTime)
+	assertEq(len(serverEvent), 0, t)
+
+	// Rejecting a connection that never reads gives up once the write times out
+	serverConn, stalledConn := net.Pipe()
+	defer stalledConn.Close()
+	rejected := make(chan struct{})
+	go func() {
+		server.reject(serverConn, "address not allowed")
+		close(rejected)
+	}()
+	select {
+	case <-rejected:
+	case <-time.After(2 * closeWriteTimeout):
+		t.Fatal("Rejecting a connection should not wait for it to read")
+	}
+
+	// Connect once the filter allows it
+	filterMutex.Lock()
+	allowAll = true
+	filterMutex.Unlock()
+	err = client.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientConnectEvent := <-serverEvent
+	assertEq(clientConnectEvent.EventType, ServerConnect, t)
+	assertEq(clientConnectEvent.ClientID, 0, t)
+
+	// Disconnect from server
+	err = client.Disconnect()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// Test limiting the number of clients and the rate at which they connect
+func TestConnectionLimits(t *testing.T) {
+	limitsList := []ConnectionLimits{
+		{MaxClients: 2},
+		{MaxClientsPerIP: 2},
+		{AcceptRate: 0.01, AcceptBurst: 2},
+	}
+	reasons := []string{"server is full", "too many connections from address", "too many connection attempts"}
+
+	for i, limits := range limitsList {
+		// Create server
+		server, serverEvent := NewServer[string, string]()
+		err := server.SetLimits(limits)
+		assertNoErr(err, t)
+
+		// Start server
+		err = server.Start("127.0.0.1", 0)
+		assertNoErr(err, t)
+		time.Sleep(waitTime)
+		host, port, err := server.GetAddr()
+		assertNoErr(err, t)
+
+		// Connect clients up to the limit
+		client1, _ := NewClient[string, string]()
+		err = client1.Connect(host, port)
+		assertNoErr(err, t)
+		client2, _ := NewClient[string, string]()
+		err = client2.Connect(host, port)
+		assertNoErr(err, t)
+		time.Sleep(waitTime)
+		clientConnectEvent := <-serverEvent
+		assertEq(clientConnectEvent.EventType, ServerConnect, t)
+		clientConnectEvent = <-serverEvent
+		assertEq(clientConnectEvent.EventType, ServerConnect, t)
+
+		// Fail to connect another client
+		client3, _ := NewClient[string, string]()
+		err = client3.Connect(host, port)
+		assert(errors.Is(err, ErrConnectionRejected), t, "Connection should be rejected")
+		assert(strings.Contains(err.Error(), reasons[i]), t, "Reason should be sent")
+
+		// Connect another client once one disconnects, unless limited by rate
+		err = client1.Disconnect()
+		assertNoErr(err, t)
+		time.Sleep(waitTime)
+		clientDisconnectEvent := <-serverEvent
+		assertEq(clientDisconnectEvent.EventType, ServerDisconnect, t)
+		err = client3.Connect(host, port)
+		if limits.AcceptRate > 0 {
+			assert(errors.Is(err, ErrConnectionRejected), t, "Connection should be rejected")
+		} else {
+			assertNoErr(err, t)
+			err = client3.Disconnect()
+			assertNoErr(err, t)
+		}
+
+		// Disconnect from server
+		err = client2.Disconnect()
+		assertNoErr(err, t)
+		time.Sleep(waitTime)
+
+		// Stop server
+		err = server.Stop()
+		assertNoErr(err, t)
+		time.Sleep(waitTime)
+	}
+}
+
+// Test limiting the rate of messages from each client
+func TestRateLimit(t *testing.T) {
+	// Start a server with a rate limit and connect a client to it
+	connect := func(limit RateLimit) (*Server[string, string], <-chan ServerEvent[string], *Client[string, string], <-chan ClientEvent[string]) {
+		server, serverEvent := NewServer[string, string]()
+		err := server.SetRateLimit(limit)
+		assertNoErr(err, t)
+		err = server.Start("127.0.0.1", 0)
+		assertNoErr(err, t)
+		time.Sleep(waitTime)
+		host, port, err := server.GetAddr()
+		assertNoErr(err, t)
+		client, clientEvent := NewClient[string, string]()
+		err = client.Connect(host, port)
+		assertNoErr(err, t)
+		time.Sleep(waitTime)
+		clientConnectEvent := <-serverEvent
+		assertEq(clientConnectEvent.EventType, ServerConnect, t)
+		return server, serverEvent, client, clientEvent
+	}
+
+	// Drop messages over the limit
+	server, serverEvent, client, _ := connect(RateLimit{MessageRate: 1, MessageBurst: 3, ByteRate: 1000, ByteBurst: 100})
+	for i := 0; i < 10; i++ {
+		err := client.Send(strconv.Itoa(i))
+		assertNoErr(err, t)
+	}
+	time.Sleep(waitTime)
+	for i := 0; i < 3; i++ {
+		serverReceiveEvent := <-serverEvent
+		assertEq(serverReceiveEvent.EventType, ServerReceive, t)
+		assertEq(serverReceiveEvent.Data, strconv.Itoa(i), t)
+	}
+	serverRateLimitedEvent := <-serverEvent
+	assertEq(serverRateLimitedEvent.EventType, ServerRateLimited, t)
+	assertEq(serverRateLimitedEvent.ClientID, 0, t)
+	assert(errors.Is(serverRateLimitedEvent.Err, ErrRateLimited), t, "Client should be rate limited")
+	assertEq(len(serverEvent), 0, t)
+
+	// Allow a message larger than the byte burst once the bucket is full
+	time.Sleep(time.Second)
+	err := client.Send(strings.Repeat("a", 200))
+	assertNoErr(err, t)
+	err = client.Send("b")
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	serverReceiveEvent := <-serverEvent
+	assertEq(serverReceiveEvent.EventType, ServerReceive, t)
+	assertEq(len(serverReceiveEvent.Data), 200, t)
+	serverRateLimitedEvent = <-serverEvent
+	assertEq(serverRateLimitedEvent.EventType, ServerRateLimited, t)
+	assertEq(len(serverEvent), 0, t)
+	err = client.Disconnect()
+	assertNoErr(err, t)
+	err = server.Stop()
+	assertNoErr(err, t)
+
+	// Delay messages over the limit
+	server, serverEvent, client, _ = connect(RateLimit{MessageRate: 20, MessageBurst: 1, Action: RateLimitDelay})
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		err = client.Send(strconv.Itoa(i))
+		assertNoErr(err, t)
+	}
+	rateLimitedEvents := 0
+	for i := 0; i < 5; i++ {
+		event := <-serverEvent
+		if event.EventType == ServerRateLimited {
+			rateLimitedEvents++
+			event = <-serverEvent
+		}
+		assertEq(event.EventType, ServerReceive, t)
+		assertEq(event.Data, strconv.Itoa(i), t)
+	}
+	assertEq(rateLimitedEvents, 1, t)
+	assert(time.Since(start) >= 150*time.Millisecond, t, "Messages should be delayed")
+	err = client.Disconnect()
+	assertNoErr(err, t)
+	err = server.Stop()
+	assertNoErr(err, t)
+
+	// Disconnect clients that exceed the limit
+	server, serverEvent, client, clientEvent := connect(RateLimit{MessageRate: 1, Action: RateLimitDisconnect})
+	err = client.Send("first")
+	assertNoErr(err, t)
+	err = client.Send("second")
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	serverReceiveEvent = <-serverEvent
+	assertEq(serverReceiveEvent.EventType, ServerReceive, t)
+	serverRateLimitedEvent = <-serverEvent
+	assertEq(serverRateLimitedEvent.EventType, ServerRateLimited, t)
+	clientDisconnectEvent := <-serverEvent
+	assertEq(clientDisconnectEvent.EventType, ServerDisconnect, t)
+	clientDisconnectedEvent := <-clientEvent
+	assertEq(clientDisconnectedEvent.EventType, ClientDisconnected, t)
+	err = server.Stop()
+	assertNoErr(err, t)
+
+	// Delay stream data over the byte limit, even when messages over the limit are dropped
+	server, serverEvent, client, _ = connect(RateLimit{ByteRate: 256 * 1024, ByteBurst: 16 * 1024})
+	streamData := make([]byte, 256*1024)
+	start = time.Now()
+	go client.SendStream(bytes.NewReader(streamData))
+	serverStreamEvent := <-serverEvent
+	assertEq(serverStreamEvent.EventType, ServerStream, t)
+	received, err := io.ReadAll(serverStreamEvent.Stream)
+	assertNoErr(err, t)
+	assertEq(len(received), len(streamData), t)
+	assert(time.Since(start) >= 700*time.Millisecond, t, "Stream data should be delayed")
+	serverRateLimitedEvent = <-serverEvent
+	assertEq(serverRateLimitedEvent.EventType, ServerRateLimited, t)
+	err = client.Disconnect()
+	assertNoErr(err, t)
+	err = server.Stop()
+	assertNoErr(err, t)
+
+	// Disconnect clients that exceed the byte limit with stream data
+	server, serverEvent, client, clientEvent = connect(RateLimit{ByteRate: 1000, ByteBurst: 1000, Action: RateLimitDisconnect})
+	go client.SendStream(bytes.NewReader(streamData))
+	serverStreamEvent = <-serverEvent
+	assertEq(serverStreamEvent.EventType, ServerStream, t)
+	serverRateLimitedEvent = <-serverEvent
+	assertEq(serverRateLimitedEvent.EventType, ServerRateLimited, t)
+	clientDisconnectEvent = <-serverEvent
+	assertEq(clientDisconnectEvent.EventType, ServerDisconnect, t)
+	clientDisconnectedEvent = <-clientEvent
+	assertEq(clientDisconnectedEvent.EventType, ClientDisconnected, t)
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// Test timing out handshakes and idle clients
+func TestTimeouts(t *testing.T) {
+	// Create server
+	server, serverEvent := NewServer[string, string]()
+	err := server.SetHandshakeTimeout(2 * waitTime)
+	assertNoErr(err, t)
+	err = server.SetIdleTimeout(5 * waitTime)
+	assertNoErr(err, t)
+	err = server.SetHeartbeat(waitTime / 2)
+	assertNoErr(err, t)
+
+	// Start server
+	err = server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Open a connection that never completes the key exchange, waiting until the server has started the key exchange
+	// so that the time it takes to generate keys does not count towards the client's idle time
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	assertNoErr(err, t)
+	defer conn.Close()
+	hello := serverHello{}
+	err = gob.NewDecoder(conn).Decode(&hello)
+	assertNoErr(err, t)
+
+	// Connect to server while the other connection is stalled
+	client, clientEvent := NewClient[string, string]()
+	err = client.SetHeartbeat(waitTime / 2)
+	assertNoErr(err, t)
+	err = client.Connect(host, port)
+	assertNoErr(err, t)
+	clientConnectEvent := <-serverEvent
+	assertEq(clientConnectEvent.EventType, ServerConnect, t)
+
+	// The stalled connection is closed once the handshake times out
+	conn.SetReadDeadline(time.Now().Add(5 * waitTime))
+	_, err = conn.Read(make([]byte, 1))
+	assertEq(err, io.EOF, t)
+
+	// Stay connected while sending messages, even though heartbeats alone do not count as activity
+	for i := 0; i < 5; i++ {
+		err = client.Send("Hello, server!")
+		assertNoErr(err, t)
+		time.Sleep(waitTime)
+		serverReceiveEvent := <-serverEvent
+		assertEq(serverReceiveEvent.EventType, ServerReceive, t)
+	}
+	assert(client.Connected(), t, "Client should be connected")
+
+	// Get disconnected after going idle
+	time.Sleep(7 * waitTime)
+	clientDisconnectEvent := <-serverEvent
+	assertEq(clientDisconnectEvent.EventType, ServerDisconnect, t)
+	assertEq(clientDisconnectEvent.Err, ErrIdleTimeout, t)
+	clientDisconnectedEvent := <-clientEvent
+	assertEq(clientDisconnectedEvent.EventType, ClientDisconnected, t)
+	assert(errors.Is(clientDisconnectedEvent.Err, ErrConnectionClosed), t, "Server should close the connection")
+	assert(strings.Contains(clientDisconnectedEvent.Err.Error(), "idle timeout"), t, "Reason should be sent")
+	assert(!client.Connected(), t, "Client should be disconnected")
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// Test stopping the server while a new connection is still being filtered
+func TestStopDuringAcceptFilter(t *testing.T) {
+	// Create server with a filter that waits until the server is stopping, and no handshake timeout
+	server, _ := NewServer[string, string]()
+	filtering := make(chan struct{})
+	stopping := make(chan struct{})
+	err := server.SetAcceptFilter(func(info ConnectionInfo) error {
+		close(filtering)
+		<-stopping
+		return nil
+	})
+	assertNoErr(err, t)
+	err = server.SetHandshakeTimeout(0)
+	assertNoErr(err, t)
+
+	// Start server
+	err = server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Open a connection that is held in the filter
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	assertNoErr(err, t)
+	defer conn.Close()
+	<-filtering
+
+	// Stop the server, then let the filter accept the connection
+	stopErr := make(chan error)
+	go func() {
+		stopErr <- server.Stop()
+	}()
+	time.Sleep(waitTime)
+	close(stopping)
+
+	// The server stops without waiting on the connection, which is closed
+	select {
+	case err = <-stopErr:
+		assertNoErr(err, t)
+	case <-time.After(10 * waitTime):
+		t.Fatal("Server should stop without waiting for the handshake")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * waitTime))
+	_, err = io.Copy(io.Discard, conn)
+	assertNoErr(err, t)
+}
+
+// Test storing metadata for each client
+func TestMetadata(t *testing.T) {
+	// Create server
+	server, serverEvent := NewServer[string, string]()
+	err := server.SetAcceptFilter(func(info ConnectionInfo) error {
+		info.Metadata.Set("addr", info.RemoteAddr.String())
+		return nil
+	})
+	assertNoErr(err, t)
+
+	// Start server
+	err = server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Connect to server
+	client, _ := NewClient[string, string]()
+	err = client.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientConnectEvent := <-serverEvent
+	assertEq(clientConnectEvent.EventType, ServerConnect, t)
+	clientHost, clientPort, err := client.GetAddr()
+	assertNoErr(err, t)
+	addr, ok := GetMetadata[string](clientConnectEvent.Metadata, "addr")
+	assert(ok, t, "Metadata should be set by the accept filter")
+	assertEq(addr, net.JoinHostPort(clientHost, strconv.Itoa(int(clientPort))), t)
+
+	// Set metadata and receive it with events
+	metadata, err := server.Metadata(0)
+	assertNoErr(err, t)
+	assertEq(metadata, clientConnectEvent.Metadata, t)
+	metadata.Set("username", "alice")
+	metadata.Set("roles", []string{"admin"})
+	err = client.Send("Hello, server!")
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	serverReceiveEvent := <-serverEvent
+	assertEq(serverReceiveEvent.EventType, ServerReceive, t)
+	username, ok := GetMetadata[string](serverReceiveEvent.Metadata, "username")
+	assert(ok, t, "Metadata should be set")
+	assertEq(username, "alice", t)
+	roles, ok := GetMetadata[[]string](serverReceiveEvent.Metadata, "roles")
+	assert(ok, t, "Metadata should be set")
+	assertEq(roles, []string{"admin"}, t)
+	_, ok = GetMetadata[int](serverReceiveEvent.Metadata, "username")
+	assert(!ok, t, "Metadata should have a different type")
+	metadata.Delete("roles")
+	_, ok = metadata.Get("roles")
+	assert(!ok, t, "Metadata should be deleted")
+	assertEq(len(metadata.Keys()), 2, t)
+
+	// A nil store has no values and ignores changes
+	var noMetadata *Metadata
+	noMetadata.Set("username", "alice")
+	noMetadata.Delete("username")
+	_, ok = noMetadata.Get("username")
+	assert(!ok, t, "Nil metadata should have no values")
+	assertEq(len(noMetadata.Keys()), 0, t)
+
+	// Get the metadata with the disconnect event, after which it is discarded
+	err = client.Disconnect()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientDisconnectEvent := <-serverEvent
+	assertEq(clientDisconnectEvent.EventType, ServerDisconnect, t)
+	username, ok = GetMetadata[string](clientDisconnectEvent.Metadata, "username")
+	assert(ok, t, "Metadata should be set")
+	assertEq(username, "alice", t)
+	_, err = server.Metadata(0)
+	assertNe(err, nil, t)
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// Test listing connected clients
+func TestClients(t *testing.T) {
+	// Create server
+	server, serverEvent := NewServer[string, string]()
+
+	// Start server
+	err := server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+	assertEq(server.ClientCount(), 0, t)
+	assertEq(len(server.Clients()), 0, t)
+
+	// Connect to server
+	start := time.Now()
+	client1, clientEvent1 := NewClient[string, string]()
+	err = client1.Connect(host, port)
+	assertNoErr(err, t)
+	client2, _ := NewClient[string, string]()
+	err = client2.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	<-serverEvent
+	<-serverEvent
+	assertEq(server.ClientCount(), 2, t)
+
+	// Exchange messages
+	for i := 0; i < 3; i++ {
+		err = client1.Send("Hello, server!")
+		assertNoErr(err, t)
+		serverReceiveEvent := <-serverEvent
+		assertEq(serverReceiveEvent.EventType, ServerReceive, t)
+	}
+	for i := 0; i < 2; i++ {
+		err = server.Send("Hello, client!", 0)
+		assertNoErr(err, t)
+		clientReceiveEvent := <-clientEvent1
+		assertEq(clientReceiveEvent.EventType, ClientReceive, t)
+	}
+
+	// List clients
+	clients := server.Clients()
+	assertEq(len(clients), 2, t)
+	assertEq(clients[0].ID, 0, t)
+	assertEq(clients[1].ID, 1, t)
+	clientHost, clientPort, err := client1.GetAddr()
+	assertNoErr(err, t)
+	assertEq(clients[0].RemoteAddr.String(), net.JoinHostPort(clientHost, strconv.Itoa(int(clientPort))), t)
+	assert(!clients[0].ConnectedAt.Before(start), t, "Client should connect after the test starts")
+	assert(clients[0].LastActivity.After(clients[0].ConnectedAt), t, "Client should be active after connecting")
+	assertEq(clients[0].MessagesIn, 3, t)
+	assertEq(clients[0].MessagesOut, 2, t)
+	assert(clients[0].BytesIn > clients[1].BytesIn, t, "Client should have sent data")
+	assert(clients[0].BytesOut > clients[1].BytesOut, t, "Client should have received data")
+	assertEq(clients[1].MessagesIn, 0, t)
+	assertEq(clients[1].MessagesOut, 0, t)
+	assertEq(clients[0].Version, protocolVersion, t)
+	assert(clients[0].Capabilities.Has(CapabilityAEAD), t, "Client should use authenticated encryption")
+	assertEq(clients[0].Codec, CodecJSON, t)
+	assert(!clients[0].Unreliable, t, "Client should not use unreliable messages")
+
+	// Disconnect from server
+	err = client1.Disconnect()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	<-serverEvent
+	assertEq(server.ClientCount(), 1, t)
+	clients = server.Clients()
+	assertEq(len(clients), 1, t)
+	assertEq(clients[0].ID, 1, t)
+	err = client2.Disconnect()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// Test collecting and publishing server and client metrics
+func TestStats(t *testing.T) {
+	// Create server that rejects every connection after the first
+	server, serverEvent := NewServer[string, int]()
+	err := server.SetValidation(ValidationSkip, nil)
+	assertNoErr(err, t)
+	accepted := false
+	err = server.SetAcceptFilter(func(info ConnectionInfo) error {
+		if accepted {
+			return fmt.Errorf("server is full")
+		}
+		accepted = true
+		return nil
+	})
+	assertNoErr(err, t)
+	assertEq(server.Stats().ConnectionsAccepted, 0, t)
+
+	// Start server
+	err = server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Connect to server
+	client, clientEvent := NewClient[any, string]()
+	err = client.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	<-serverEvent
+	rejectedClient, _ := NewClient[any, string]()
+	err = rejectedClient.Connect(host, port)
+	assert(errors.Is(err, ErrConnectionRejected), t, "Connection should be rejected")
+	time.Sleep(waitTime)
+
+	// Exchange messages
+	err = client.Send(42)
+	assertNoErr(err, t)
+	serverReceiveEvent := <-serverEvent
+	assertEq(serverReceiveEvent.EventType, ServerReceive, t)
+	err = server.Send("Hello, client!", 0)
+	assertNoErr(err, t)
+	clientReceiveEvent := <-clientEvent
+	assertEq(clientReceiveEvent.EventType, ClientReceive, t)
+
+	// Send a message the server cannot decode
+	err = client.Send("Hello, server!")
+	assertNoErr(err, t)
+	serverErrorEvent := <-serverEvent
+	assertEq(serverErrorEvent.EventType, ServerError, t)
+
+	// Check server stats
+	serverStats := server.Stats()
+	assertEq(serverStats.ConnectionsAccepted, 1, t)
+	assertEq(serverStats.ConnectionsRejected, 1, t)
+	assertEq(serverStats.HandshakesFailed, 0, t)
+	assertEq(serverStats.HandshakesInProgress, 0, t)
+	assertEq(serverStats.ClientsConnected, 1, t)
+	assertEq(serverStats.MessagesReceived, 2, t)
+	assertEq(serverStats.MessagesSent, 1, t)
+	assertEq(serverStats.DecodeErrors, 1, t)
+	assertEq(serverStats.DecryptErrors, 0, t)
+	assert(serverStats.BytesReceived > 0, t, "Server should have received data")
+	assert(serverStats.BytesSent > 0, t, "Server should have sent data")
+	assertEq(serverStats.EventQueueDepth, 0, t)
+	assertEq(serverStats.HandshakeLatency.Count, 1, t)
+	assertEq(len(serverStats.HandshakeLatency.Counts), len(serverStats.HandshakeLatency.Bounds)+1, t)
+	assert(serverStats.HandshakeLatency.Sum > 0, t, "Handshake should take time")
+
+	// Check client stats
+	clientStats := client.Stats()
+	assert(clientStats.Connected, t, "Client should be connected")
+	assertEq(clientStats.HandshakesFailed, 0, t)
+	assertEq(clientStats.MessagesSent, 2, t)
+	assertEq(clientStats.MessagesReceived, 1, t)
+	assertEq(clientStats.BytesSent, serverStats.BytesReceived, t)
+	assertEq(clientStats.BytesReceived, serverStats.BytesSent, t)
+	assertEq(clientStats.HandshakeLatency.Count, 1, t)
+	rejectedStats := rejectedClient.Stats()
+	assert(!rejectedStats.Connected, t, "Rejected client should not be connected")
+	assertEq(rejectedStats.HandshakesFailed, 1, t)
+	assertEq(rejectedStats.HandshakeLatency.Count, 0, t)
+
+	// Publish stats
+	err = server.PublishExpvar("godtp_test_server")
+	assertNoErr(err, t)
+	err = server.PublishExpvar("godtp_test_server")
+	assertNe(err, nil, t)
+	published := expvar.Get("godtp_test_server").String()
+	assert(strings.Contains(published, `"ConnectionsAccepted":1`), t, "Published stats should include counters")
+
+	// Disconnect from server
+	err = client.Disconnect()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	<-serverEvent
+	assertEq(server.Stats().ClientsConnected, 0, t)
+	assertEq(server.Stats().MessagesReceived, 2, t)
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// Test logging connection lifecycle events and protocol errors
+func TestLogging(t *testing.T) {
+	// Create server and client loggers
+	var serverLog, clientLog strings.Builder
+	var serverLogMutex, clientLogMutex sync.Mutex
+	serverLogger := slog.New(slog.NewTextHandler(&lockedWriter{writer: &serverLog, mutex: &serverLogMutex}, nil))
+	clientLogger := slog.New(slog.NewTextHandler(&lockedWriter{writer: &clientLog, mutex: &clientLogMutex}, nil))
+
+	// Create server that rejects every connection after the first
+	server, serverEvent := NewServer[string, string]()
+	err := server.SetLogger(serverLogger)
+	assertNoErr(err, t)
+	accepted := false
+	err = server.SetAcceptFilter(func(info ConnectionInfo) error {
+		if accepted {
+			return fmt.Errorf("server is full")
+		}
+		accepted = true
+		return nil
+	})
+	assertNoErr(err, t)
+
+	// Start server
+	err = server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Connect to server
+	client, _ := NewClient[string, string]()
+	err = client.SetLogger(clientLogger)
+	assertNoErr(err, t)
+	err = client.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	<-serverEvent
+	rejectedClient, _ := NewClient[string, string]()
+	err = rejectedClient.Connect(host, port)
+	assert(errors.Is(err, ErrConnectionRejected), t, "Connection should be rejected")
+	time.Sleep(waitTime)
+
+	// Disconnect from server
+	err = client.Disconnect()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	<-serverEvent
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+
+	// Check logs
+	serverLogMutex.Lock()
+	serverOutput := serverLog.String()
+	serverLogMutex.Unlock()
+	clientLogMutex.Lock()
+	clientOutput := clientLog.String()
+	clientLogMutex.Unlock()
+	for _, expected := range []string{
+		`msg="server started"`,
+		`msg="client connected" client_id=0 remote_addr=127.0.0.1:`,
+		`codec=json`,
+		`msg="connection rejected" remote_addr=127.0.0.1:`,
+		`reason="server is full"`,
+		`msg="client disconnected" client_id=0`,
+		`msg="server stopped"`,
+	} {
+		assert(strings.Contains(serverOutput, expected), t, "Server log should contain "+expected)
+	}
+	for _, expected := range []string{
+		`msg="connected to server" remote_addr=` + net.JoinHostPort(host, strconv.Itoa(int(port))),
+		`msg="disconnected from server"`,
+	} {
+		assert(strings.Contains(clientOutput, expected), t, "Client log should contain "+expected)
+	}
+	assert(!strings.Contains(clientOutput, "level=WARN"), t, "Client log should not contain warnings")
+}
+
+// A writer that serializes writes with a mutex
+type lockedWriter struct {
+	writer io.Writer
+	mutex  *sync.Mutex
+}
+
+// Write data while holding the mutex
+func (writer *lockedWriter) Write(p []byte) (int, error) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	return writer.writer.Write(p)
+}
+
+// Test sending headers alongside messages
+func TestHeaders(t *testing.T) {
+	// Encode and decode headers
+	headers := Headers{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "request-id": "42"}
+	headerBytes, err := encodeHeaders(headers)
+	assertNoErr(err, t)
+	decodedHeaders, rest, err := decodeHeaders(append(headerBytes, "payload"...))
+	assertNoErr(err, t)
+	assertEq(decodedHeaders, headers, t)
+	assertEq(string(rest), "payload", t)
+	_, _, err = decodeHeaders(headerBytes[:len(headerBytes)-1])
+	assertNe(err, nil, t)
+	_, err = encodeHeaders(Headers{strings.Repeat("k", maxHeaderKeySize+1): "value"})
+	assertNe(err, nil, t)
+	assertEq(Headers(nil).Clone(), Headers(nil), t)
+	assertEq(Headers(nil).Get("request-id"), "", t)
+
+	// Create server
+	server, serverEvent := NewServer[string, string]()
+	err = server.SetCompression(true, 0)
+	assertNoErr(err, t)
+
+	// Start server
+	err = server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+
+	// Connect to server
+	client, clientEvent := NewClient[string, string]()
+	err = client.SetCompression(true, 0)
+	assertNoErr(err, t)
+	client.InterceptOutbound(func(message Message[string], next Handler[string]) error {
+		if message.Headers == nil {
+			message.Headers = Headers{}
+		}
+		message.Headers["client"] = "intercepted"
+		return next(message)
+	})
+	err = client.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	<-serverEvent
+	assert(client.settings.capabilities.Has(CapabilityHeaders), t, "Headers should be negotiated")
+
+	// Send headers to the server
+	err = client.SendWithMeta("Hello, server!", headers)
+	assertNoErr(err, t)
+	serverReceiveEvent := <-serverEvent
+	assertEq(serverReceiveEvent.EventType, ServerReceive, t)
+	assertEq(serverReceiveEvent.Data, "Hello, server!", t)
+	assertEq(serverReceiveEvent.Headers.Get("traceparent"), headers["traceparent"], t)
+	assertEq(serverReceiveEvent.Headers.Get("request-id"), "42", t)
+	assertEq(serverReceiveEvent.Headers.Get("client"), "intercepted", t)
+	_, ok := headers["client"]
+	assert(!ok, t, "Interceptors should not modify the caller's headers")
+
+	// Send headers to the client
+	err = server.SendWithMeta("Hello, client!", Headers{"request-id": "43"}, 0)
+	assertNoErr(err, t)
+	clientReceiveEvent := <-clientEvent
+	assertEq(clientReceiveEvent.EventType, ClientReceive, t)
+	assertEq(clientReceiveEvent.Data, "Hello, client!", t)
+	assertEq(clientReceiveEvent.Headers, Headers{"request-id": "43"}, t)
+
+	// Send without headers
+	err = server.Send("Hello again, client!", 0)
+	assertNoErr(err, t)
+	clientReceiveEvent = <-clientEvent
+	assertEq(clientReceiveEvent.Headers, Headers(nil), t)
+
+	// Send headers to a peer that does not support them
+	server.mutex.RLock()
+	server.clients[0].settings.capabilities &^= CapabilityHeaders
+	server.mutex.RUnlock()
+	err = server.SendWithMeta("Hello, client!", Headers{"request-id": "44"}, 0)
+	assert(errors.Is(err, ErrHeadersUnsupported), t, "Headers should be unsupported")
+	err = server.Send("Hello, client!", 0)
+	assertNoErr(err, t)
+	clientReceiveEvent = <-clientEvent
+	assertEq(clientReceiveEvent.EventType, ClientReceive, t)
+
+	// Disconnect from server
+	err = client.Disconnect()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	<-serverEvent
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// Test limiting the size of messages, decompressed data and key exchange input
+func TestMessageLimits(t *testing.T) {
+	// Reject messages claiming to be larger than the limit without allocating them
+	_, err := readMessage(bytes.NewReader(encodeMessageSize(defaultMaxMessageSize+1)), defaultMaxMessageSize)
+	assert(errors.Is(err, ErrMessageTooLarge), t, "Message should be too large")
+	_, err = readMessageLimit(bytes.NewReader(encodeMessage(make([]byte, 100))), 99)
+	assert(errors.Is(err, ErrMessageTooLarge), t, "Message should be too large")
+	_, err = readMessage(bytes.NewReader(encodeMessageSize(100)), defaultMaxMessageSize)
+	assertEq(err, io.ErrUnexpectedEOF, t)
+	message, err := readMessage(bytes.NewReader(encodeMessage([]byte("Hello"))), defaultMaxMessageSize)
+	assertNoErr(err, t)
+	assertEq(string(message), "Hello", t)
+
+	// Reject data that decompresses beyond the limit
+	bomb, err := compress(make([]byte, defaultMaxMessageSize+1))
+	assertNoErr(err, t)
+	assert(len(bomb) < defaultMaxMessageSize/100, t, "Compressed data should be small")
+	_, err = decompress(bomb, defaultMaxMessageSize)
+	assert(errors.Is(err, ErrMessageTooLarge), t, "Decompressed data should be too large")
+
+	// A maximum size of 0 disables the limit
+	_, err = readMessage(bytes.NewReader(encodeMessageSize(defaultMaxMessageSize+1)), 0)
+	assertEq(err, io.ErrUnexpectedEOF, t)
+	decompressed, err := decompress(bomb, 0)
+	assertNoErr(err, t)
+	assertEq(len(decompressed), defaultMaxMessageSize+1, t)
+	assertNoErr(checkMessageSize(decompressed, 0), t)
+
+	// Reject weak or malformed public keys
+	assertNe(checkPublicKey(rsa.PublicKey{}), nil, t)
+	weakKey, err := rsa.GenerateKey(cryptorand.Reader, 1024)
+	assertNoErr(err, t)
+	assertNe(checkPublicKey(weakKey.PublicKey), nil, t)
+	key, err := newRSAKeys()
+	assertNoErr(err, t)
+	assertNoErr(checkPublicKey(key.PublicKey), t)
+	key.PublicKey.E = 2
+	assertNe(checkPublicKey(key.PublicKey), nil, t)
+
+	// Create server with a small maximum message size
+	server, serverEvent := NewServer[string, string]()
+	err = server.SetMaxMessageSize(1024)
+	assertNoErr(err, t)
+
+	// Start server
+	err = server.Start("127.0.0.1", 0)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	host, port, err := server.GetAddr()
+	assertNoErr(err, t)
+	err = server.SetMaxMessageSize(0)
+	assertNe(err, nil, t)
+
+	// Connect to server
+	client, _ := NewClient[string, string]()
+	err = client.Connect(host, port)
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+	clientConnectEvent := <-serverEvent
+	assertEq(clientConnectEvent.EventType, ServerConnect, t)
+
+	// Sending messages over the limit fails
+	err = server.Send(strings.Repeat("a", 2048))
+	assert(errors.Is(err, ErrMessageTooLarge), t, "Message should be too large to send")
+	err = client.Send("Hello, server!")
+	assertNoErr(err, t)
+	serverReceiveEvent := <-serverEvent
+	assertEq(serverReceiveEvent.Data, "Hello, server!", t)
+
+	// Clients sending messages over the server's limit are disconnected
+	err = client.Send(strings.Repeat("a", 2048))
+	assertNoErr(err, t)
+	clientDisconnectEvent := <-serverEvent
+	assertEq(clientDisconnectEvent.EventType, ServerDisconnect, t)
+
+	// Stop server
+	err = server.Stop()
+	assertNoErr(err, t)
+	time.Sleep(waitTime)
+}
+
+// A connection that reads from a fixed input and discards writes, for feeding untrusted input to handshakes
+type fuzzConn struct {
+	reader io.Reader
+}
+
+// Read from the fixed input
+func (conn *fuzzConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+// Discard written data
+func (conn *fuzzConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// Close the connection, which has nothing to release
+func (conn *fuzzConn) Close() error {
+	return nil
+}
+
+// Get the local address, which is always empty
+func (conn *fuzzConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// Get the remote address, which is always empty
+func (conn *fuzzConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// Ignore deadlines, since reads never block
+func (conn *fuzzConn) SetDeadline(deadline time.Time) error {
+	return nil
+}
+
+// Ignore read deadlines, since reads never block
+func (conn *fuzzConn) SetReadDeadline(deadline time.Time) error {
+	return nil
+}
+
+// Ignore write deadlines, since writes never block
+func (conn *fuzzConn) SetWriteDeadline(deadline time.Time) error {
+	return nil
+}
+
+// Test reading size-prefixed messages from untrusted input
+func FuzzReadMessage(f *testing.F) {
+	f.Add(encodeMessage([]byte("Hello, server!")))
+	f.Add(encodeMessageSize(defaultMaxMessageSize + 1))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		message, err := readMessage(bytes.NewReader(data), defaultMaxMessageSize)
+		if err != nil {
+			return
+		}
+		if len(message) > defaultMaxMessageSize || len(message) > len(data) {
+			t.Fatalf("message of %d bytes read from %d bytes of input", len(message), len(data))
+		}
+	})
+}
+
+// Test decoding frames from untrusted input, and that encoded frames decode to the same header and data
+func FuzzDecodeFrame(f *testing.F) {
+	data, _ := encodeFrame(frameHeader{kind: frameData}, []byte(`"Hello, server!"`), false, 0)
+	f.Add(data)
+	data, _ = encodeFrame(frameHeader{kind: frameStreamData, id: 7}, []byte("stream data"), false, 0)
+	f.Add(data)
+	data, _ = encodeFrame(frameHeader{kind: frameData, headers: Headers{"request-id": "42"}}, bytes.Repeat([]byte("a"), 100), true, 0)
+	f.Add(data)
+	f.Add([]byte{byte(frameData), flagCompressed | flagHeaders | flagID})
+
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		header, data, err := decodeFrame(frame, defaultMaxMessageSize)
+		if err != nil {
+			return
+		}
+		if len(data) > defaultMaxMessageSize {
+			t.Fatalf("frame data of %d bytes exceeds the maximum message size", len(data))
+		}
+
+		// A decoded frame survives encoding again
+		encoded, err := encodeFrame(header, data, false, 0)
+		if err != nil {
+			if len(header.headers) > 0 {
+				return
+			}
+			t.Fatalf("failed to encode decoded frame: %v", err)
+		}
+		decodedHeader, decodedData, err := decodeFrame(encoded, defaultMaxMessageSize)
+		assertNoErr(err, t)
+		assertEq(decodedHeader.kind, header.kind, t)
+		assertEq(decodedHeader.id, header.id, t)
+		assertEq(len(decodedHeader.headers), len(header.headers), t)
+		assertEq(decodedData, data, t)
+	})
+}
+
+// Test decrypting untrusted ciphertext
+func FuzzDecrypt(f *testing.F) {
+	key := bytes.Repeat([]byte{1}, aesKeySize)
+	ciphertext, _ := aeadEncrypt(key, []byte("Hello, server!"))
+	f.Add(ciphertext)
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, ciphertext []byte) {
+		plaintext, err := aeadDecrypt(key, ciphertext)
+		if err == nil && len(plaintext) >= len(ciphertext) {
+			t.Fatalf("plaintext of %d bytes from ciphertext of %d bytes", len(plaintext), len(ciphertext))
+		}
+	})
+}
+
+// Test decoding untrusted data with each codec, with and without a registry
+func FuzzDecodeData(f *testing.F) {
+	registry := NewRegistry()
+	err := Register[testPing](registry, "ping")
+	if err != nil {
+		f.Fatal(err)
+	}
+	pingBytes, _ := encodeData[any](testPing{N: 1}, CodecJSON, registry)
+	f.Add(pingBytes, uint8(CodecJSON), true)
+	gobBytes, _ := encodeObjectCodec("Hello, server!", CodecGob)
+	f.Add(gobBytes, uint8(CodecGob), false)
+	f.Add([]byte(`"Hello, server!"`), uint8(CodecJSON), false)
+	f.Add([]byte{0xff}, uint8(CodecRaw), true)
+
+	f.Fuzz(func(t *testing.T, data []byte, codec uint8, registered bool) {
+		if registered {
+			// Ignore errors, since only panics and hangs are of interest
+			decodeValidData[any](data, Codec(codec), registry, nil)
+			return
+		}
+
+		decodeValidData[string](data, Codec(codec), nil, nil)
+		decodeValidData[[]byte](data, Codec(codec), nil, nil)
+		decodeValidData[map[string]any](data, Codec(codec), nil, nil)
+	})
+}
+
+// Test the client's key exchange with untrusted input from a server
+func FuzzClientHandshake(f *testing.F) {
+	key, err := newRSAKeys()
+	if err != nil {
+		f.Fatal(err)
+	}
+	var hello bytes.Buffer
+	err = gob.NewEncoder(&hello).Encode(newProtocolConfig().hello(key.PublicKey))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(hello.Bytes())
+	f.Add(append(hello.Bytes(), encodeMessage(bytes.Repeat([]byte{1}, 64))...))
+	hello.Reset()
+	err = gob.NewEncoder(&hello).Encode(serverHello{Versions: supportedVersions, Codecs: defaultCodecs})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(hello.Bytes())
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		client, _ := NewClient[string, string]()
+		client.sock = &fuzzConn{reader: bytes.NewReader(input)}
+
+		// The input comes from no real server, so the key exchange can never succeed
+		err := client.exchangeKeys()
+		if err == nil {
+			t.Fatalf("key exchange succeeded with fuzzed input")
+		}
+	})
+}
+
+// Test the server's key exchange with untrusted input from a client
+func FuzzServerHandshake(f *testing.F) {
+	privateKey, err := newRSAKeys()
+	if err != nil {
+		f.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{1}, aesKeySize)
+	choice, err := newProtocolConfig().negotiate(newProtocolConfig().hello(privateKey.PublicKey))
+	if err != nil {
+		f.Fatal(err)
+	}
+	choiceBytes, err := encodeHandshake(&choice)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(key, choiceBytes, false)
+	f.Add(key, []byte{}, false)
+	f.Add([]byte{1, 2, 3}, choiceBytes, false)
+	f.Add(key, choiceBytes, true)
+
+	f.Fuzz(func(t *testing.T, key []byte, choice []byte, raw bool) {
+		// Build the client's messages from the fuzzed key and choice, unless they are used as-is
+		var input []byte
+		if raw {
+			input = append(encodeMessage(key), encodeMessage(choice)...)
+		} else {
+			encryptedKey, err := rsaEncrypt(privateKey.PublicKey, key)
+			if err != nil {
+				return
+			}
+			encryptedChoice, err := aeadEncrypt(key, choice)
+			if err != nil {
+				encryptedChoice = choice
+			}
+			input = append(encodeMessage(encryptedKey), encodeMessage(encryptedChoice)...)
+		}
+
+		server, _ := NewServer[string, string]()
+		err := server.exchangeKeysWith(privateKey, 0, &fuzzConn{reader: bytes.NewReader(input)}, newMetadata())
+		if err != nil {
+			return
+		}
+
+		// A completed key exchange registers the client with the negotiated settings
+		client, ok := server.clients[0]
+		if !ok {
+			t.Fatalf("client not registered after key exchange")
+		}
+		assertEq(len(client.key), aesKeySize, t)
+		_, err = server.config.accept(clientHello{
+			Version:           client.settings.version,
+			Capabilities:      client.settings.capabilities,
+			Codec:             client.settings.codec,
+			HeartbeatInterval: client.settings.heartbeat,
+		})
+		assertNoErr(err, t)
+	})
+}
+
+// Start a server on a loopback port for a benchmark, stopping it when the benchmark ends
+func startBenchServer[S any, R any](b *testing.B, server *Server[S, R]) (string, uint16) {
+	err := server.Start("127.0.0.1", 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		// Ignore stop error, since the benchmark is already over
+		server.Stop()
+	})
+
+	host, port, err := server.GetAddr()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return host, port
+}
+
+// Connect a client for a benchmark, disconnecting it when the benchmark ends
+func connectBenchClient[S any, R any](b *testing.B, client *Client[S, R], host string, port uint16) {
+	err := client.Connect(host, port)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		if client.Connected() {
+			// Ignore disconnect error, since the benchmark is already over
+			client.Disconnect()
+		}
+	})
+}
+
+// Wait for the next event of a given type during a benchmark, failing on any other event. There is no timeout, since a
+// timer per event would count toward the allocations being measured, so a lost event is caught by the test timeout.
+func awaitBenchEvent[E any](b *testing.B, events <-chan E, matches func(event E) bool) E {
+	event, ok := <-events
+	if !ok {
+		b.Fatal("event channel closed")
+	}
+	if !matches(event) {
+		b.Fatalf("unexpected event: %+v", event)
+	}
+
+	return event
+}
+
+// Check a server event's type during a benchmark
+func isServerEvent[R any](eventType ServerEventType) func(event ServerEvent[R]) bool {
+	return func(event ServerEvent[R]) bool { return event.EventType == eventType }
+}
+
+// Check a client event's type during a benchmark
+func isClientEvent[R any](eventType ClientEventType) func(event ClientEvent[R]) bool {
+	return func(event ClientEvent[R]) bool { return event.EventType == eventType }
+}
+
+// Benchmark connecting to and disconnecting from a server, including the key exchange
+func BenchmarkHandshake(b *testing.B) {
+	server, serverEvent := NewServer[string, string]()
+	host, port := startBenchServer(b, server)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// Each connection generates a server key pair and exchanges keys
+	for i := 0; i < b.N; i++ {
+		client, _ := NewClient[string, string]()
+		err := client.Connect(host, port)
+		if err != nil {
+			b.Fatal(err)
+		}
+		awaitBenchEvent(b, serverEvent, isServerEvent[string](ServerConnect))
+
+		err = client.Disconnect()
+		if err != nil {
+			b.Fatal(err)
+		}
+		awaitBenchEvent(b, serverEvent, isServerEvent[string](ServerDisconnect))
+	}
+}
+
+// Benchmark the round-trip latency of a small message echoed by the server
+func BenchmarkRoundTrip(b *testing.B) {
+	// Create a server that echoes messages back
+	server, serverEvent := NewServer[string, string]()
+	host, port := startBenchServer(b, server)
+	go func() {
+		for event := range serverEvent {
+			if event.EventType == ServerReceive {
+				// Ignore send errors, since the client stops waiting when the benchmark ends
+				server.Send(event.Data, event.ClientID)
+			}
+		}
+	}()
+
+	client, clientEvent := NewClient[string, string]()
+	connectBenchClient(b, client, host, port)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// Each operation is one small message to the server and back
+	for i := 0; i < b.N; i++ {
+		err := client.Send("Hello, server!")
+		if err != nil {
+			b.Fatal(err)
+		}
+		awaitBenchEvent(b, clientEvent, isClientEvent[string](ClientReceive))
+	}
+}
+
+// Benchmark the throughput of messages of several sizes sent without waiting for each to arrive
+func BenchmarkThroughput(b *testing.B) {
+	for _, size := range []int{1 << 10, 64 << 10, 1 << 20} {
+		b.Run(strconv.Itoa(size>>10)+"KiB", func(b *testing.B) {
+			server, serverEvent := NewRawServer()
+			host, port := startBenchServer(b, server)
+			client, _ := NewRawClient()
+			connectBenchClient(b, client, host, port)
+			awaitBenchEvent(b, serverEvent, isServerEvent[[]byte](ServerConnect))
+
+			payload := make([]byte, size)
+			_, err := cryptorand.Read(payload)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			// Send messages without waiting for each to arrive
+			sendErr := make(chan error, 1)
+			go func() {
+				for i := 0; i < b.N; i++ {
+					err := client.Send(payload)
+					if err != nil {
+						sendErr <- err
+						return
+					}
+				}
+				sendErr <- nil
+			}()
+
+			for i := 0; i < b.N; i++ {
+				awaitBenchEvent(b, serverEvent, isServerEvent[[]byte](ServerReceive))
+			}
+			err = <-sendErr
+			if err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+// Benchmark sending a message to every connected client
+func BenchmarkBroadcast(b *testing.B) {
+	for _, clientCount := range []int{1, 10, 50} {
+		b.Run(strconv.Itoa(clientCount)+"Clients", func(b *testing.B) {
+			server, serverEvent := NewServer[string, string]()
+			host, port := startBenchServer(b, server)
+
+			clientEvents := make([]<-chan ClientEvent[string], clientCount)
+			for i := range clientEvents {
+				client, clientEvent := NewClient[string, string]()
+				connectBenchClient(b, client, host, port)
+				awaitBenchEvent(b, serverEvent, isServerEvent[string](ServerConnect))
+				clientEvents[i] = clientEvent
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			// Each operation is one message delivered to every client
+			for i := 0; i < b.N; i++ {
+				err := server.Send("Hello, clients!")
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, clientEvent := range clientEvents {
+					awaitBenchEvent(b, clientEvent, isClientEvent[string](ClientReceive))
+				}
+			}
+		})
+	}
+}
+
+// Benchmark encoding, encrypting, decrypting and decoding a small message without the network
+func BenchmarkMessageEncoding(b *testing.B) {
+	key, err := newAESKey()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+
+	// Encode, encrypt, decrypt and decode a small message, as each send and receive does, without the network
+	for i := 0; i < b.N; i++ {
+		dataBytes, err := encodeData("Hello, server!", CodecJSON, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		frame, err := encodeFrame(frameHeader{kind: frameData}, dataBytes, false, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		encryptedData, err := aeadEncrypt(key, frame)
+		if err != nil {
+			b.Fatal(err)
+		}
+		message, err := readMessage(bytes.NewReader(encodeMessage(encryptedData)), defaultMaxMessageSize)
+		if err != nil {
+			b.Fatal(err)
+		}
+		decryptedData, err := aeadDecrypt(key, message)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, dataBytes, err = decodeFrame(decryptedData, defaultMaxMessageSize)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = decodeData[string](dataBytes, CodecJSON, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
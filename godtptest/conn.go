@@ -0,0 +1,201 @@
+package godtptest
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The address of every in-memory listener
+const listenerAddr = Addr("memory")
+
+// Addr defines the address of an in-memory listener or connection
+type Addr string
+
+// Network returns the name of the network
+func (addr Addr) Network() string {
+	return "memory"
+}
+
+// String returns the address
+func (addr Addr) String() string {
+	return string(addr)
+}
+
+// Faults defines faults injected into the writes on one end of an in-memory connection. godtp writes each frame in a
+// single write, so writes correspond to frames once the key exchange is complete. Writes are counted from 0 starting
+// when the faults are set.
+type Faults struct {
+	// Drop reports whether to silently drop the nth write
+	Drop func(n int) bool
+	// Corrupt reports whether to flip the last byte of the nth write, which fails its decryption
+	Corrupt func(n int) bool
+	// Delay is the time to wait before each write
+	Delay time.Duration
+	// Split writes into chunks of at most this many bytes, if positive
+	Split int
+}
+
+// Nth returns a function reporting whether n is one of the given indices, for use in Faults
+func Nth(indices ...int) func(n int) bool {
+	return func(n int) bool {
+		for _, index := range indices {
+			if n == index {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Every returns a function reporting whether n is a multiple of k, for use in Faults
+func Every(k int) func(n int) bool {
+	return func(n int) bool {
+		return k > 0 && n%k == 0
+	}
+}
+
+// Conn defines one end of an in-memory connection, with faults that can be injected into its writes
+type Conn struct {
+	net.Conn
+	local  Addr
+	remote Addr
+	peer   *Conn
+	mutex  sync.Mutex
+	faults Faults
+	writes int
+}
+
+// Create the two ends of an in-memory connection, with the dialing end first
+func newConnPair(id uint64) (*Conn, *Conn) {
+	dialEnd, listenEnd := net.Pipe()
+	dialAddr := Addr(fmt.Sprintf("memory:%d", id))
+
+	dialConn := &Conn{Conn: dialEnd, local: dialAddr, remote: listenerAddr}
+	listenConn := &Conn{Conn: listenEnd, local: listenerAddr, remote: dialAddr}
+	dialConn.peer = listenConn
+	listenConn.peer = dialConn
+
+	return dialConn, listenConn
+}
+
+// LocalAddr returns the address of this end of the connection
+func (conn *Conn) LocalAddr() net.Addr {
+	return conn.local
+}
+
+// RemoteAddr returns the address of the other end of the connection
+func (conn *Conn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+// Peer returns the other end of the connection
+func (conn *Conn) Peer() *Conn {
+	return conn.peer
+}
+
+// SetFaults sets the faults injected into writes on this end of the connection, and restarts the write count
+func (conn *Conn) SetFaults(faults Faults) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.faults = faults
+	conn.writes = 0
+}
+
+// Write data to the other end of the connection, applying any faults
+func (conn *Conn) Write(p []byte) (int, error) {
+	conn.mutex.Lock()
+	faults := conn.faults
+	n := conn.writes
+	conn.writes++
+	conn.mutex.Unlock()
+
+	if faults.Delay > 0 {
+		time.Sleep(faults.Delay)
+	}
+
+	if faults.Drop != nil && faults.Drop(n) {
+		return len(p), nil
+	}
+
+	data := p
+	if faults.Corrupt != nil && faults.Corrupt(n) && len(p) > 0 {
+		data = append([]byte{}, p...)
+		data[len(data)-1] ^= 0xff
+	}
+
+	if faults.Split <= 0 {
+		return conn.Conn.Write(data)
+	}
+
+	written := 0
+	for written < len(data) {
+		end := min(written+faults.Split, len(data))
+		chunk, err := conn.Conn.Write(data[written:end])
+		written += chunk
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// Listener defines an in-memory listener that connections are made to with Dial
+type Listener struct {
+	conns     chan *Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	nextID    atomic.Uint64
+}
+
+// NewListener creates a new in-memory listener
+func NewListener() *Listener {
+	return &Listener{
+		conns: make(chan *Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Accept waits for the next connection made with Dial
+func (listener *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case <-listener.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close the listener. Connections already accepted stay open.
+func (listener *Listener) Close() error {
+	listener.closeOnce.Do(func() {
+		close(listener.done)
+	})
+
+	return nil
+}
+
+// Addr returns the listener's address
+func (listener *Listener) Addr() net.Addr {
+	return listenerAddr
+}
+
+// Dial connects to the listener, returning the dialing end of the connection once it is accepted. The accepted end
+// is available through Peer.
+func (listener *Listener) Dial() (*Conn, error) {
+	dialConn, listenConn := newConnPair(listener.nextID.Add(1))
+
+	select {
+	case listener.conns <- listenConn:
+		return dialConn, nil
+	case <-listener.done:
+		// Ignore close errors, since the connection was never used
+		dialConn.Close()
+		listenConn.Close()
+		return nil, net.ErrClosed
+	}
+}
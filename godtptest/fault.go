@@ -0,0 +1,170 @@
+package godtptest
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// FaultProfile defines faults applied at random to the writes on a connection. Unlike Faults, which targets specific
+// writes on an in-memory connection, a profile can wrap any connection, and its faults are chosen by a random source
+// seeded per connection, so a run can be reproduced from its seed. A zero profile applies no faults.
+type FaultProfile struct {
+	// The time to wait before each write
+	Latency time.Duration
+	// The maximum random time added to the latency of each write
+	Jitter time.Duration
+	// The maximum number of bytes written per second, if positive
+	Bandwidth int
+	// The probability that a write is split into several smaller writes
+	PartialWriteRate float64
+	// The probability that a random byte of a write is flipped
+	CorruptRate float64
+	// The probability that the connection is closed instead of writing
+	DisconnectRate float64
+}
+
+// FaultConn defines a connection that applies a fault profile to its writes
+type FaultConn struct {
+	net.Conn
+	mutex   sync.Mutex
+	profile FaultProfile
+	random  *rand.Rand
+}
+
+// NewFaultConn wraps a connection to apply a fault profile to its writes, choosing faults from a source with the
+// given seed
+func NewFaultConn(conn net.Conn, profile FaultProfile, seed int64) *FaultConn {
+	return &FaultConn{
+		Conn:    conn,
+		profile: profile,
+		random:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+// SetProfile replaces the fault profile, for example to inject faults only once a connection is established
+func (conn *FaultConn) SetProfile(profile FaultProfile) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.profile = profile
+}
+
+// The faults chosen for a single write
+type writeFaults struct {
+	delay      time.Duration
+	disconnect bool
+	corrupt    int
+	chunks     []int
+}
+
+// Choose the faults for a write of the given size. Every random value is drawn in a fixed order, so the choices
+// depend only on the seed and the sequence of write sizes.
+func (conn *FaultConn) chooseFaults(size int) writeFaults {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	profile := conn.profile
+	faults := writeFaults{
+		delay:   profile.Latency,
+		corrupt: -1,
+	}
+
+	if profile.Jitter > 0 {
+		faults.delay += time.Duration(conn.random.Int63n(int64(profile.Jitter) + 1))
+	}
+
+	if profile.Bandwidth > 0 {
+		faults.delay += time.Duration(float64(size) / float64(profile.Bandwidth) * float64(time.Second))
+	}
+
+	if conn.random.Float64() < profile.DisconnectRate {
+		faults.disconnect = true
+		return faults
+	}
+
+	if size > 0 && conn.random.Float64() < profile.CorruptRate {
+		faults.corrupt = conn.random.Intn(size)
+	}
+
+	if size > 1 && conn.random.Float64() < profile.PartialWriteRate {
+		remaining := size
+		for remaining > 0 {
+			chunk := 1 + conn.random.Intn(remaining)
+			faults.chunks = append(faults.chunks, chunk)
+			remaining -= chunk
+		}
+	}
+
+	return faults
+}
+
+// Write data, applying the fault profile
+func (conn *FaultConn) Write(p []byte) (int, error) {
+	faults := conn.chooseFaults(len(p))
+
+	if faults.delay > 0 {
+		time.Sleep(faults.delay)
+	}
+
+	if faults.disconnect {
+		// Ignore close error, since the write fails either way
+		conn.Conn.Close()
+		return 0, net.ErrClosed
+	}
+
+	data := p
+	if faults.corrupt >= 0 {
+		data = append([]byte{}, p...)
+		data[faults.corrupt] ^= 0xff
+	}
+
+	if len(faults.chunks) == 0 {
+		return conn.Conn.Write(data)
+	}
+
+	written := 0
+	for _, chunk := range faults.chunks {
+		n, err := conn.Conn.Write(data[written : written+chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// FaultListener defines a listener that applies a fault profile to the connections it accepts
+type FaultListener struct {
+	net.Listener
+	profile FaultProfile
+	mutex   sync.Mutex
+	seed    int64
+}
+
+// NewFaultListener wraps a listener to apply a fault profile to the connections it accepts. Each accepted connection
+// is seeded with the given seed plus the number of connections accepted before it.
+func NewFaultListener(listener net.Listener, profile FaultProfile, seed int64) *FaultListener {
+	return &FaultListener{
+		Listener: listener,
+		profile:  profile,
+		seed:     seed,
+	}
+}
+
+// Accept waits for the next connection and wraps it
+func (listener *FaultListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	listener.mutex.Lock()
+	seed := listener.seed
+	listener.seed++
+	listener.mutex.Unlock()
+
+	return NewFaultConn(conn, listener.profile, seed), nil
+}
@@ -0,0 +1,186 @@
+package godtptest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wkhallen/godtp"
+)
+
+// Test exchanging messages over a connected pair
+func TestPair(t *testing.T) {
+	// Create a connected pair
+	pair := NewPair[string, string](t)
+	assert(pair.Server.ClientCount() == 1, t, "Server should have a client")
+	assert(pair.Client.Connected(), t, "Client should be connected")
+	assert(pair.ClientConn.Peer() == pair.ServerConn, t, "Connection ends should be peers")
+	assert(pair.ClientConn.RemoteAddr() == pair.ServerConn.LocalAddr(), t, "Addresses should match")
+
+	// Exchange messages
+	err := pair.Client.Send("Hello, server!")
+	assertNoErr(err, t)
+	serverReceiveEvent := ExpectServerEvent(t, pair.ServerEvents, godtp.ServerReceive)
+	assert(serverReceiveEvent.Data == "Hello, server!", t, "Server should receive the message")
+	err = pair.Server.Send("Hello, client!", pair.ClientID)
+	assertNoErr(err, t)
+	clientReceiveEvent := ExpectClientEvent(t, pair.ClientEvents, godtp.ClientReceive)
+	assert(clientReceiveEvent.Data == "Hello, client!", t, "Client should receive the message")
+	ExpectNoEvent(t, pair.ServerEvents, 50*time.Millisecond)
+
+	// Disconnect from server
+	err = pair.Client.Disconnect()
+	assertNoErr(err, t)
+	ExpectServerEvent(t, pair.ServerEvents, godtp.ServerDisconnect)
+}
+
+// Test the in-memory listener and configuring a pair before it connects
+func TestListener(t *testing.T) {
+	// Connections to a closed listener fail
+	listener := NewListener()
+	assert(listener.Addr().Network() == "memory", t, "Listener should be in memory")
+	err := listener.Close()
+	assertNoErr(err, t)
+	_, err = listener.Dial()
+	assert(errors.Is(err, net.ErrClosed), t, "Dial should fail once the listener is closed")
+	_, err = listener.Accept()
+	assert(errors.Is(err, net.ErrClosed), t, "Accept should fail once the listener is closed")
+
+	// Configure the pair before connecting
+	pair := NewPair(t, func(server *godtp.Server[string, string], client *godtp.Client[string, string]) {
+		err := server.SetCodecs(godtp.CodecGob)
+		assertNoErr(err, t)
+		err = client.SetCodecs(godtp.CodecGob)
+		assertNoErr(err, t)
+	})
+	clients := pair.Server.Clients()
+	assert(len(clients) == 1, t, "Server should have a client")
+	assert(clients[0].Codec == godtp.CodecGob, t, "Client should use the configured codec")
+	assert(clients[0].RemoteAddr == pair.ClientConn.LocalAddr(), t, "Server should see the client's address")
+}
+
+// Test dropping, splitting, delaying and corrupting writes
+func TestFaults(t *testing.T) {
+	pair := NewPair[string, string](t)
+
+	// Drop a message
+	pair.ClientConn.SetFaults(Faults{Drop: Nth(0)})
+	err := pair.Client.Send("dropped")
+	assertNoErr(err, t)
+	err = pair.Client.Send("delivered")
+	assertNoErr(err, t)
+	serverReceiveEvent := ExpectServerEvent(t, pair.ServerEvents, godtp.ServerReceive)
+	assert(serverReceiveEvent.Data == "delivered", t, "Dropped message should not arrive")
+
+	// Split a message into single bytes
+	pair.ServerConn.SetFaults(Faults{Split: 1})
+	err = pair.Server.Send("split", pair.ClientID)
+	assertNoErr(err, t)
+	clientReceiveEvent := ExpectClientEvent(t, pair.ClientEvents, godtp.ClientReceive)
+	assert(clientReceiveEvent.Data == "split", t, "Split message should arrive")
+
+	// Delay a message
+	pair.ServerConn.SetFaults(Faults{Delay: 100 * time.Millisecond})
+	start := time.Now()
+	err = pair.Server.Send("delayed", pair.ClientID)
+	assertNoErr(err, t)
+	ExpectClientEvent(t, pair.ClientEvents, godtp.ClientReceive)
+	assert(time.Since(start) >= 100*time.Millisecond, t, "Message should be delayed")
+
+	// Corrupt a message, which disconnects the client
+	pair.ClientConn.SetFaults(Faults{Corrupt: Every(1)})
+	err = pair.Client.Send("corrupted")
+	assertNoErr(err, t)
+	ExpectServerEvent(t, pair.ServerEvents, godtp.ServerDisconnect)
+	ExpectClientEvent(t, pair.ClientEvents, godtp.ClientDisconnected)
+	assert(pair.Server.Stats().DecryptErrors == 1, t, "Corrupted message should fail decryption")
+}
+
+// Test reproducible random faults on connections and listeners
+func TestFaultProfile(t *testing.T) {
+	// Write through a fault profile and collect what arrives
+	profile := FaultProfile{CorruptRate: 0.5, PartialWriteRate: 0.5, Jitter: time.Millisecond}
+	transfer := func(seed int64) []byte {
+		writer, reader := net.Pipe()
+		conn := NewFaultConn(writer, profile, seed)
+		go func() {
+			for i := 0; i < 20; i++ {
+				_, err := conn.Write(bytes.Repeat([]byte{byte(i)}, 16))
+				if err != nil {
+					return
+				}
+			}
+		}()
+
+		received := make([]byte, 20*16)
+		_, err := io.ReadFull(reader, received)
+		assertNoErr(err, t)
+		return received
+	}
+
+	// Faults are reproducible from the seed
+	first := transfer(1)
+	assert(bytes.Equal(first, transfer(1)), t, "Faults should be the same for the same seed")
+	assert(!bytes.Equal(first, transfer(2)), t, "Faults should differ for different seeds")
+	corrupted := 0
+	for i, b := range first {
+		if b != byte(i/16) {
+			corrupted++
+		}
+	}
+	assert(corrupted > 0 && corrupted < 20, t, "Some writes should be corrupted")
+
+	// Create server behind a faulty listener
+	server, serverEvents := godtp.NewServer[string, string]()
+	listener := NewListener()
+	err := server.Serve(NewFaultListener(listener, FaultProfile{Latency: 10 * time.Millisecond, PartialWriteRate: 1}, 1))
+	assertNoErr(err, t)
+	defer server.Stop()
+
+	// Connect over a faulty connection
+	client, clientEvents := godtp.NewClient[string, string]()
+	dialConn, err := listener.Dial()
+	assertNoErr(err, t)
+	conn := NewFaultConn(dialConn, FaultProfile{Jitter: 10 * time.Millisecond, PartialWriteRate: 1, Bandwidth: 1 << 20}, 1)
+	err = client.ConnectConn(conn)
+	assertNoErr(err, t)
+	connectEvent := ExpectServerEvent(t, serverEvents, godtp.ServerConnect)
+
+	// Exchange messages despite partial writes
+	err = client.Send("Hello, server!")
+	assertNoErr(err, t)
+	serverReceiveEvent := ExpectServerEvent(t, serverEvents, godtp.ServerReceive)
+	assert(serverReceiveEvent.Data == "Hello, server!", t, "Server should receive the message")
+	start := time.Now()
+	err = server.Send("Hello, client!", connectEvent.ClientID)
+	assertNoErr(err, t)
+	clientReceiveEvent := ExpectClientEvent(t, clientEvents, godtp.ClientReceive)
+	assert(clientReceiveEvent.Data == "Hello, client!", t, "Client should receive the message")
+	assert(time.Since(start) >= 10*time.Millisecond, t, "Message should be delayed")
+
+	// Disconnect at random
+	conn.SetProfile(FaultProfile{DisconnectRate: 1})
+	err = client.Send("Goodbye, server!")
+	assert(errors.Is(err, net.ErrClosed), t, "Send should fail once disconnected")
+	ExpectServerEvent(t, serverEvents, godtp.ServerDisconnect)
+	ExpectClientEvent(t, clientEvents, godtp.ClientDisconnected)
+}
+
+// Assert a condition
+func assert(value bool, t *testing.T, err string) {
+	if !value {
+		t.Errorf(err)
+		panic(err)
+	}
+}
+
+// Assert no error occurred
+func assertNoErr(err error, t *testing.T) {
+	if err != nil {
+		t.Errorf(err.Error())
+		panic(err.Error())
+	}
+}
@@ -0,0 +1,155 @@
+// Package godtptest provides an in-memory transport, connected server and client pairs, event expectations and fault
+// injection for testing applications built on godtp.
+package godtptest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wkhallen/godtp"
+)
+
+// Timeout is how long the expectation helpers wait for an event before failing the test
+var Timeout = 5 * time.Second
+
+// Serve starts a server on a new in-memory listener, and stops it when the test ends
+func Serve[S any, R any](t testing.TB, server *godtp.Server[S, R]) *Listener {
+	t.Helper()
+
+	listener := NewListener()
+	err := server.Serve(listener)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if server.Serving() {
+			// Ignore stop error, since the test is already over
+			server.Stop()
+		}
+	})
+
+	return listener
+}
+
+// Connect connects a client to an in-memory listener, and disconnects it when the test ends. Returns the client's end
+// of the connection, whose peer is the server's end.
+func Connect[S any, R any](t testing.TB, listener *Listener, client *godtp.Client[S, R]) *Conn {
+	t.Helper()
+
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatalf("failed to dial server: %v", err)
+	}
+
+	err = client.ConnectConn(conn)
+	if err != nil {
+		t.Fatalf("failed to connect client: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if client.Connected() {
+			// Ignore disconnect error, since the test is already over
+			client.Disconnect()
+		}
+	})
+
+	return conn
+}
+
+// Pair defines a server and a client connected to it in memory
+type Pair[S any, R any] struct {
+	Server       *godtp.Server[S, R]
+	ServerEvents <-chan godtp.ServerEvent[R]
+	Client       *godtp.Client[R, S]
+	ClientEvents <-chan godtp.ClientEvent[S]
+	Listener     *Listener
+	// The client's end of the connection, whose faults affect messages sent to the server
+	ClientConn *Conn
+	// The server's end of the connection, whose faults affect messages sent to the client
+	ServerConn *Conn
+	// The ID the server gave the client
+	ClientID uint
+}
+
+// NewPair creates a server and a client connected to it in memory, after applying any configuration functions to
+// them. The server's connect event is consumed. Both are shut down when the test ends.
+func NewPair[S any, R any](t testing.TB, configure ...func(server *godtp.Server[S, R], client *godtp.Client[R, S])) *Pair[S, R] {
+	t.Helper()
+
+	server, serverEvents := godtp.NewServer[S, R]()
+	client, clientEvents := godtp.NewClient[R, S]()
+	for _, apply := range configure {
+		apply(server, client)
+	}
+
+	listener := Serve(t, server)
+	conn := Connect(t, listener, client)
+	connectEvent := ExpectServerEvent(t, serverEvents, godtp.ServerConnect)
+
+	return &Pair[S, R]{
+		Server:       server,
+		ServerEvents: serverEvents,
+		Client:       client,
+		ClientEvents: clientEvents,
+		Listener:     listener,
+		ClientConn:   conn,
+		ServerConn:   conn.Peer(),
+		ClientID:     connectEvent.ClientID,
+	}
+}
+
+// Next waits for the next event, failing the test if none arrives within the timeout or the channel is closed
+func Next[E any](t testing.TB, events <-chan E) E {
+	t.Helper()
+
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatalf("event channel closed")
+		}
+		return event
+	case <-time.After(Timeout):
+		t.Fatalf("no event within %v", Timeout)
+	}
+
+	var zero E
+	return zero
+}
+
+// ExpectServerEvent waits for the next server event, failing the test if it is not of the given type
+func ExpectServerEvent[R any](t testing.TB, events <-chan godtp.ServerEvent[R], eventType godtp.ServerEventType) godtp.ServerEvent[R] {
+	t.Helper()
+
+	event := Next(t, events)
+	if event.EventType != eventType {
+		t.Fatalf("expected server event type %d, got %d (error: %v)", eventType, event.EventType, event.Err)
+	}
+
+	return event
+}
+
+// ExpectClientEvent waits for the next client event, failing the test if it is not of the given type
+func ExpectClientEvent[S any](t testing.TB, events <-chan godtp.ClientEvent[S], eventType godtp.ClientEventType) godtp.ClientEvent[S] {
+	t.Helper()
+
+	event := Next(t, events)
+	if event.EventType != eventType {
+		t.Fatalf("expected client event type %d, got %d (error: %v)", eventType, event.EventType, event.Err)
+	}
+
+	return event
+}
+
+// ExpectNoEvent fails the test if an event arrives within the given duration
+func ExpectNoEvent[E any](t testing.TB, events <-chan E, wait time.Duration) {
+	t.Helper()
+
+	select {
+	case event, ok := <-events:
+		if ok {
+			t.Fatalf("unexpected event: %+v", event)
+		}
+	case <-time.After(wait):
+	}
+}
@@ -0,0 +1,224 @@
+package godtp
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// The current protocol version
+const protocolVersion = 1
+
+// The default amount of time a new connection has to complete the key exchange
+const defaultHandshakeTimeout = 10 * time.Second
+
+// Protocol versions supported by this implementation
+var supportedVersions = []uint{protocolVersion}
+
+// ErrIncompatiblePeer is returned when a peer shares no protocol version or settings with the local side
+var ErrIncompatiblePeer = errors.New("incompatible peer")
+
+// Capabilities defines a set of optional protocol features
+type Capabilities uint32
+
+// Capability values. CapabilityAEAD is required by protocol version 1, and peers without it are refused, so that it
+// cannot be stripped from the plaintext handshake to downgrade the connection.
+const (
+	CapabilityCompression Capabilities = 1 << iota
+	CapabilityHeartbeat
+	CapabilityAEAD
+	CapabilityHeaders
+	CapabilityDatagrams
+)
+
+// Has returns a boolean value representing whether all the given capabilities are present
+func (capabilities Capabilities) Has(other Capabilities) bool {
+	return capabilities&other == other
+}
+
+// The server's opening handshake message
+type serverHello struct {
+	Versions          []uint
+	Capabilities      Capabilities
+	Codecs            []Codec
+	HeartbeatInterval time.Duration
+	PublicKey         rsa.PublicKey
+	Error             string
+}
+
+// The client's choice of protocol settings
+type clientHello struct {
+	Version           uint
+	Capabilities      Capabilities
+	Codec             Codec
+	HeartbeatInterval time.Duration
+}
+
+// The server's response to the client's choice of protocol settings
+type serverAccept struct {
+	Error string
+}
+
+// The settings negotiated for a connection
+type protocolSettings struct {
+	version      uint
+	capabilities Capabilities
+	codec        Codec
+	heartbeat    time.Duration
+}
+
+// The local protocol preferences of a server or client
+type protocolConfig struct {
+	codecs               []Codec
+	compression          bool
+	compressionThreshold int
+	heartbeat            time.Duration
+	registry             *Registry
+	maxStreams           int
+	maxMessageSize       int
+	unreliable           bool
+}
+
+// Create the default protocol preferences
+func newProtocolConfig() protocolConfig {
+	return protocolConfig{
+		codecs:         defaultCodecs,
+		maxStreams:     defaultMaxStreams,
+		maxMessageSize: defaultMaxMessageSize,
+	}
+}
+
+// Get the capabilities supported by the local side
+func (config protocolConfig) capabilities() Capabilities {
+	capabilities := CapabilityAEAD | CapabilityHeaders
+
+	if config.compression {
+		capabilities |= CapabilityCompression
+	}
+
+	if config.heartbeat > 0 {
+		capabilities |= CapabilityHeartbeat
+	}
+
+	if config.unreliable {
+		capabilities |= CapabilityDatagrams
+	}
+
+	return capabilities
+}
+
+// Build the server's opening handshake message
+func (config protocolConfig) hello(publicKey rsa.PublicKey) serverHello {
+	return serverHello{
+		Versions:          supportedVersions,
+		Capabilities:      config.capabilities(),
+		Codecs:            config.codecs,
+		HeartbeatInterval: config.heartbeat,
+		PublicKey:         publicKey,
+	}
+}
+
+// Choose the best protocol settings supported by both the client and the server
+func (config protocolConfig) negotiate(hello serverHello) (clientHello, error) {
+	if hello.Error != "" {
+		return clientHello{}, fmt.Errorf("%w: %s", ErrConnectionRejected, hello.Error)
+	}
+
+	version, found := uint(0), false
+	for _, v := range hello.Versions {
+		if slices.Contains(supportedVersions, v) && (!found || v > version) {
+			version, found = v, true
+		}
+	}
+	if !found {
+		return clientHello{}, fmt.Errorf("%w: no common protocol version (server supports %v)", ErrIncompatiblePeer, hello.Versions)
+	}
+
+	codecIndex := slices.IndexFunc(config.codecs, func(codec Codec) bool {
+		return slices.Contains(hello.Codecs, codec)
+	})
+	if codecIndex == -1 {
+		return clientHello{}, fmt.Errorf("%w: no common codec", ErrIncompatiblePeer)
+	}
+
+	capabilities := config.capabilities() & hello.Capabilities
+	if !capabilities.Has(CapabilityAEAD) {
+		return clientHello{}, fmt.Errorf("%w: server does not support authenticated encryption", ErrIncompatiblePeer)
+	}
+
+	if config.unreliable && !capabilities.Has(CapabilityDatagrams) {
+		return clientHello{}, fmt.Errorf("%w: server does not support unreliable messages", ErrIncompatiblePeer)
+	}
+
+	heartbeat := time.Duration(0)
+	if capabilities.Has(CapabilityHeartbeat) {
+		heartbeat = max(config.heartbeat, hello.HeartbeatInterval)
+	}
+
+	return clientHello{
+		Version:           version,
+		Capabilities:      capabilities,
+		Codec:             config.codecs[codecIndex],
+		HeartbeatInterval: heartbeat,
+	}, nil
+}
+
+// Validate the client's choice of protocol settings
+func (config protocolConfig) accept(hello clientHello) (protocolSettings, error) {
+	if !slices.Contains(supportedVersions, hello.Version) {
+		return protocolSettings{}, fmt.Errorf("unsupported protocol version %d", hello.Version)
+	}
+
+	if !slices.Contains(config.codecs, hello.Codec) {
+		return protocolSettings{}, fmt.Errorf("unsupported codec")
+	}
+
+	if hello.Capabilities&^config.capabilities() != 0 {
+		return protocolSettings{}, fmt.Errorf("unsupported capabilities")
+	}
+
+	if !hello.Capabilities.Has(CapabilityAEAD) {
+		return protocolSettings{}, fmt.Errorf("authenticated encryption is required")
+	}
+
+	if hello.Capabilities.Has(CapabilityHeartbeat) && hello.HeartbeatInterval < config.heartbeat {
+		return protocolSettings{}, fmt.Errorf("invalid heartbeat interval")
+	}
+
+	return hello.settings(), nil
+}
+
+// Get the protocol settings chosen by the client
+func (hello clientHello) settings() protocolSettings {
+	return protocolSettings{
+		version:      hello.Version,
+		capabilities: hello.Capabilities,
+		codec:        hello.Codec,
+		heartbeat:    hello.HeartbeatInterval,
+	}
+}
+
+// Get the amount of time without receiving anything after which the peer is considered gone
+func (settings protocolSettings) readTimeout() time.Duration {
+	if settings.capabilities.Has(CapabilityHeartbeat) {
+		return settings.heartbeat * heartbeatTolerance
+	}
+
+	return 0
+}
+
+// Encode a handshake message
+func encodeHandshake(message any) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(message)
+	return buffer.Bytes(), err
+}
+
+// Decode a handshake message
+func decodeHandshake(byteString []byte, message any) error {
+	return gob.NewDecoder(bytes.NewReader(byteString)).Decode(message)
+}
@@ -0,0 +1,108 @@
+package godtp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// ErrHeadersUnsupported is returned when sending headers to a peer that does not support them
+var ErrHeadersUnsupported = errors.New("peer does not support message headers")
+
+// Limits on the headers of a single message
+const (
+	maxHeaders         = 255
+	maxHeaderKeySize   = 255
+	maxHeaderValueSize = 65535
+)
+
+// Headers defines metadata carried alongside a message's payload, such as a W3C traceparent or a request ID. Headers
+// are not encoded with the message's codec, so they can be read without decoding the payload.
+type Headers map[string]string
+
+// Get a header's value. A nil map has no headers.
+func (headers Headers) Get(key string) string {
+	return headers[key]
+}
+
+// Clone returns a copy of the headers, or nil if there are none
+func (headers Headers) Clone() Headers {
+	if len(headers) == 0 {
+		return nil
+	}
+
+	clone := make(Headers, len(headers))
+	for key, value := range headers {
+		clone[key] = value
+	}
+
+	return clone
+}
+
+// Encode headers as a count followed by each length-prefixed key and value, in key order
+func encodeHeaders(headers Headers) ([]byte, error) {
+	if len(headers) > maxHeaders {
+		return []byte{}, fmt.Errorf("too many headers: %d > %d", len(headers), maxHeaders)
+	}
+
+	keys := make([]string, 0, len(headers))
+	size := 1
+	for key, value := range headers {
+		if len(key) > maxHeaderKeySize {
+			return []byte{}, fmt.Errorf("header key %q is too long", key)
+		}
+		if len(value) > maxHeaderValueSize {
+			return []byte{}, fmt.Errorf("header %q value is too long", key)
+		}
+
+		keys = append(keys, key)
+		size += 1 + len(key) + 2 + len(value)
+	}
+	slices.Sort(keys)
+
+	encoded := make([]byte, 0, size)
+	encoded = append(encoded, byte(len(keys)))
+	for _, key := range keys {
+		encoded = append(encoded, byte(len(key)))
+		encoded = append(encoded, key...)
+		encoded = binary.BigEndian.AppendUint16(encoded, uint16(len(headers[key])))
+		encoded = append(encoded, headers[key]...)
+	}
+
+	return encoded, nil
+}
+
+// Decode headers from the start of data, returning them and the rest of the data
+func decodeHeaders(data []byte) (Headers, []byte, error) {
+	if len(data) < 1 {
+		return nil, []byte{}, fmt.Errorf("headers too short")
+	}
+
+	count := int(data[0])
+	data = data[1:]
+	headers := make(Headers, count)
+
+	for i := 0; i < count; i++ {
+		if len(data) < 1 {
+			return nil, []byte{}, fmt.Errorf("headers too short")
+		}
+		keySize := int(data[0])
+		data = data[1:]
+		if len(data) < keySize+2 {
+			return nil, []byte{}, fmt.Errorf("headers too short")
+		}
+		key := string(data[:keySize])
+		data = data[keySize:]
+
+		valueSize := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		if len(data) < valueSize {
+			return nil, []byte{}, fmt.Errorf("headers too short")
+		}
+		headers[key] = string(data[:valueSize])
+		data = data[valueSize:]
+	}
+
+	return headers, data, nil
+}
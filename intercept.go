@@ -0,0 +1,41 @@
+package godtp
+
+import "sync"
+
+// Interceptor defines a function that runs around each message sent or received. An interceptor can inspect the
+// message, pass a transformed message to next, delay by blocking before calling next, or reject the message by
+// returning an error without calling next.
+type Interceptor[T any] func(message Message[T], next Handler[T]) error
+
+// A chain of interceptors that can be extended while in use
+type interceptorChain[T any] struct {
+	mutex        sync.RWMutex
+	interceptors []Interceptor[T]
+}
+
+// Add interceptors to the end of the chain
+func (chain *interceptorChain[T]) add(interceptors ...Interceptor[T]) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	chain.interceptors = append(chain.interceptors, interceptors...)
+}
+
+// Get the interceptors currently in the chain
+func (chain *interceptorChain[T]) get() []Interceptor[T] {
+	chain.mutex.RLock()
+	defer chain.mutex.RUnlock()
+
+	return chain.interceptors
+}
+
+// Run a message through interceptors, in the order they were added, and then the final handler
+func runInterceptors[T any](interceptors []Interceptor[T], message Message[T], final Handler[T]) error {
+	if len(interceptors) == 0 {
+		return final(message)
+	}
+
+	return interceptors[0](message, func(message Message[T]) error {
+		return runInterceptors(interceptors[1:], message, final)
+	})
+}
@@ -0,0 +1,208 @@
+package godtp
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrIdleTimeout is reported when a client is disconnected for sending nothing for too long
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// ErrRateLimited is reported when a client sends messages faster than its rate limit allows
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// ConnectionLimits defines limits on the connections a server accepts. A zero value for any limit disables it.
+type ConnectionLimits struct {
+	// The maximum number of clients connected at once, including clients still completing the key exchange
+	MaxClients int
+	// The maximum number of clients connected at once from a single IP address
+	MaxClientsPerIP int
+	// The sustained number of connections accepted per second
+	AcceptRate float64
+	// The number of connections that can be accepted in a burst above the accept rate, at least 1
+	AcceptBurst int
+}
+
+// RateLimitAction defines what happens to messages from a client that exceeds its rate limit
+type RateLimitAction uint8
+
+// Rate limit action values
+const (
+	// RateLimitDrop drops messages over the limit
+	RateLimitDrop RateLimitAction = iota
+	// RateLimitDelay stops reading from the client until the limit allows the message
+	RateLimitDelay
+	// RateLimitDisconnect disconnects the client
+	RateLimitDisconnect
+)
+
+// RateLimit defines limits on the messages each client can send. A zero rate disables that limit. Messages larger than
+// the byte burst are allowed once the bucket is full, and the excess is paid for by later messages. Data sent over
+// streams, including by SendStream and SendFile, counts toward the byte rate but not the message rate. Since stream
+// data cannot be dropped, it is delayed instead under RateLimitDrop.
+type RateLimit struct {
+	// The sustained number of messages per second
+	MessageRate float64
+	// The number of messages that can be sent in a burst above the message rate, at least 1
+	MessageBurst int
+	// The sustained number of message bytes per second
+	ByteRate float64
+	// The number of bytes that can be sent in a burst above the byte rate, at least 1
+	ByteBurst int
+	// What happens to messages over the limit
+	Action RateLimitAction
+}
+
+// Check whether any limit is set
+func (limit RateLimit) enabled() bool {
+	return limit.MessageRate > 0 || limit.ByteRate > 0
+}
+
+// A limiter of the messages received from a single client
+type rateLimiter struct {
+	action   RateLimitAction
+	messages *tokenBucket
+	bytes    *tokenBucket
+	mutex    sync.Mutex
+	limited  bool
+}
+
+// Create a new rate limiter, or nil if no limit is set
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if !limit.enabled() {
+		return nil
+	}
+
+	limiter := &rateLimiter{
+		action: limit.Action,
+	}
+	if limit.MessageRate > 0 {
+		limiter.messages = newTokenBucket(limit.MessageRate, limit.MessageBurst)
+	}
+	if limit.ByteRate > 0 {
+		limiter.bytes = newTokenBucket(limit.ByteRate, limit.ByteBurst)
+	}
+
+	return limiter
+}
+
+// Account for a message of the given size. Returns how long to wait before handling the message if it is delayed,
+// whether the message is over the limit, and whether this is the first message over the limit since the client was
+// last within it.
+func (limiter *rateLimiter) limit(size int, canDelay bool) (time.Duration, bool, bool) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	wait := time.Duration(0)
+	if limiter.messages != nil {
+		wait = max(wait, limiter.messages.wait(now, 1))
+	}
+	if limiter.bytes != nil {
+		wait = max(wait, limiter.bytes.wait(now, float64(size)))
+	}
+
+	exceeded := wait > 0
+	violation := exceeded && !limiter.limited
+	limiter.limited = exceeded
+
+	if exceeded && (!canDelay || limiter.action != RateLimitDelay) {
+		return 0, true, violation
+	}
+
+	if limiter.messages != nil {
+		limiter.messages.take(1)
+	}
+	if limiter.bytes != nil {
+		limiter.bytes.take(float64(size))
+	}
+
+	return wait, false, violation
+}
+
+// Account for stream data of the given size, which counts toward the byte limit only. Stream data is delayed rather
+// than dropped, so it is only over the limit when the client is disconnected for exceeding it. Returns the same values
+// as limit.
+func (limiter *rateLimiter) limitStream(size int) (time.Duration, bool, bool) {
+	if limiter.bytes == nil {
+		return 0, false, false
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	wait := limiter.bytes.wait(time.Now(), float64(size))
+	exceeded := wait > 0
+	violation := exceeded && !limiter.limited
+	limiter.limited = exceeded
+
+	if exceeded && limiter.action == RateLimitDisconnect {
+		return 0, true, violation
+	}
+
+	limiter.bytes.take(float64(size))
+	return wait, false, violation
+}
+
+// A token bucket rate limiter
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Create a new token bucket that starts full
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(max(burst, 1)),
+		tokens: float64(max(burst, 1)),
+		last:   time.Now(),
+	}
+}
+
+// Refill the bucket according to the time passed since it was last refilled
+func (bucket *tokenBucket) refill(now time.Time) {
+	bucket.tokens = min(bucket.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	bucket.last = now
+}
+
+// Take a token if one is available, returning whether one was taken
+func (bucket *tokenBucket) allow() bool {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	bucket.refill(time.Now())
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+	return true
+}
+
+// Get how long to wait until the bucket can pay for n tokens, once refilled to the given time. Requests larger than the
+// bucket can wait until the bucket is full.
+func (bucket *tokenBucket) wait(now time.Time, n float64) time.Duration {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	bucket.refill(now)
+	missing := min(n, bucket.burst) - bucket.tokens
+	if missing <= 0 {
+		return 0
+	}
+
+	return time.Duration(missing / bucket.rate * float64(time.Second))
+}
+
+// Take n tokens, leaving the bucket in debt if it has too few
+func (bucket *tokenBucket) take(n float64) {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	bucket.tokens -= n
+}
@@ -0,0 +1,64 @@
+package godtp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+)
+
+// A log handler that discards every record
+type discardHandler struct{}
+
+// Enabled reports that no level is handled
+func (handler discardHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return false
+}
+
+// Handle discards a record
+func (handler discardHandler) Handle(ctx context.Context, record slog.Record) error {
+	return nil
+}
+
+// WithAttrs returns the same handler, since there is nothing to attach attributes to
+func (handler discardHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return handler
+}
+
+// WithGroup returns the same handler, since there is nothing to group
+func (handler discardHandler) WithGroup(name string) slog.Handler {
+	return handler
+}
+
+// A logger that discards everything, used when no logger is set
+var discardLogger = slog.New(discardHandler{})
+
+// Get a logger, or the discard logger if it is nil
+func loggerOrDiscard(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return discardLogger
+	}
+
+	return logger
+}
+
+// Get a logger with attributes identifying a client
+func clientLogger(logger *slog.Logger, clientID uint, addr net.Addr) *slog.Logger {
+	return logger.With(slog.Uint64("client_id", uint64(clientID)), slog.Any("remote_addr", addr))
+}
+
+// Check whether an error is the expected result of a connection being closed
+func isClosedError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed)
+}
+
+// Log the reason a connection ended, at a level depending on whether it ended cleanly
+func logDisconnect(logger *slog.Logger, message string, reason error) {
+	if reason == nil || isClosedError(reason) {
+		logger.Info(message)
+		return
+	}
+
+	logger.Warn(message, slog.Any("error", reason))
+}
@@ -0,0 +1,84 @@
+package godtp
+
+import "sync"
+
+// Metadata defines a store of values attached to a connected client, such as a username or roles. A client's
+// metadata is discarded once the client disconnects.
+type Metadata struct {
+	mutex  sync.RWMutex
+	values map[string]any
+}
+
+// Create a new empty metadata store
+func newMetadata() *Metadata {
+	return &Metadata{
+		values: make(map[string]any),
+	}
+}
+
+// Set a value. Setting a value in a nil store does nothing.
+func (metadata *Metadata) Set(key string, value any) {
+	if metadata == nil {
+		return
+	}
+
+	metadata.mutex.Lock()
+	defer metadata.mutex.Unlock()
+
+	metadata.values[key] = value
+}
+
+// Get a value. A nil store has no values.
+func (metadata *Metadata) Get(key string) (any, bool) {
+	if metadata == nil {
+		return nil, false
+	}
+
+	metadata.mutex.RLock()
+	defer metadata.mutex.RUnlock()
+
+	value, ok := metadata.values[key]
+	return value, ok
+}
+
+// Delete a value. Deleting a value from a nil store does nothing.
+func (metadata *Metadata) Delete(key string) {
+	if metadata == nil {
+		return
+	}
+
+	metadata.mutex.Lock()
+	defer metadata.mutex.Unlock()
+
+	delete(metadata.values, key)
+}
+
+// Keys returns the keys of all values in the store
+func (metadata *Metadata) Keys() []string {
+	if metadata == nil {
+		return []string{}
+	}
+
+	metadata.mutex.RLock()
+	defer metadata.mutex.RUnlock()
+
+	keys := make([]string, 0, len(metadata.values))
+	for key := range metadata.values {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// GetMetadata gets a value of type T from a metadata store. The boolean is false if the value is missing or has a
+// different type.
+func GetMetadata[T any](metadata *Metadata, key string) (T, bool) {
+	value, ok := metadata.Get(key)
+	if !ok {
+		var zero T
+		return zero, false
+	}
+
+	typed, ok := value.(T)
+	return typed, ok
+}
@@ -0,0 +1,182 @@
+package godtp
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// The maximum length of a registered message type name
+const maxTypeNameSize = 255
+
+// ErrUnknownMessageType is reported when a message is tagged with a type name that is not registered
+var ErrUnknownMessageType = errors.New("unknown message type")
+
+// Registry defines a set of named message types. A server or client using a registry can send any registered type,
+// tagged with its name, and receives messages decoded into their registered types.
+type Registry struct {
+	mutex sync.RWMutex
+	types map[string]reflect.Type
+	names map[reflect.Type]string
+}
+
+// NewRegistry creates a new empty message type registry
+func NewRegistry() *Registry {
+	return &Registry{
+		types: make(map[string]reflect.Type),
+		names: make(map[reflect.Type]string),
+	}
+}
+
+// Register a message type under a name. The same name must be used for the type on both sides of a connection.
+func Register[T any](registry *Registry, name string) error {
+	typ := reflect.TypeFor[T]()
+	if typ.Kind() == reflect.Interface {
+		return fmt.Errorf("message types must be concrete")
+	}
+
+	if len(name) == 0 || len(name) > maxTypeNameSize {
+		return fmt.Errorf("message type names must be between 1 and %d bytes long", maxTypeNameSize)
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if _, ok := registry.types[name]; ok {
+		return fmt.Errorf("message type name %q is already registered", name)
+	}
+
+	if existing, ok := registry.names[typ]; ok {
+		return fmt.Errorf("message type %s is already registered as %q", typ, existing)
+	}
+
+	registry.types[name] = typ
+	registry.names[typ] = name
+
+	return nil
+}
+
+// Name returns the name a value's type is registered under
+func (registry *Registry) Name(value any) (string, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	name, ok := registry.names[reflect.TypeOf(value)]
+	return name, ok
+}
+
+// Encode a value of a registered type, tagged with its type name
+func (registry *Registry) encode(value any, codec Codec) ([]byte, error) {
+	name, ok := registry.Name(value)
+	if !ok {
+		return []byte{}, fmt.Errorf("message type %T is not registered", value)
+	}
+
+	valueBytes, err := encodeValueCodec(value, codec)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	message := make([]byte, 1, 1+len(name)+len(valueBytes))
+	message[0] = byte(len(name))
+	message = append(message, name...)
+	return append(message, valueBytes...), nil
+}
+
+// Decode a tagged value into its registered type
+func (registry *Registry) decode(byteString []byte, codec Codec) (any, error) {
+	if len(byteString) < 1 || len(byteString) < 1+int(byteString[0]) {
+		return nil, fmt.Errorf("message type tag too short")
+	}
+
+	nameEnd := 1 + int(byteString[0])
+	name := string(byteString[1:nameEnd])
+	valueBytes := byteString[nameEnd:]
+
+	registry.mutex.RLock()
+	typ, ok := registry.types[name]
+	registry.mutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownMessageType, name)
+	}
+
+	value := reflect.New(typ)
+	err := decodeValueCodec(valueBytes, value.Interface(), codec)
+	if err != nil {
+		return nil, err
+	}
+
+	return value.Elem().Interface(), nil
+}
+
+// Encode a value of any type using a codec
+func encodeValueCodec(value any, codec Codec) ([]byte, error) {
+	switch codec {
+	case CodecJSON:
+		return json.Marshal(value)
+	case CodecGob:
+		var buffer bytes.Buffer
+		err := gob.NewEncoder(&buffer).Encode(value)
+		return buffer.Bytes(), err
+	case CodecRaw:
+		raw, ok := value.([]byte)
+		if !ok {
+			return []byte{}, fmt.Errorf("raw codec requires a byte slice")
+		}
+		return raw, nil
+	default:
+		return []byte{}, fmt.Errorf("unknown codec")
+	}
+}
+
+// Decode a value into the value pointed to by target using a codec
+func decodeValueCodec(byteString []byte, target any, codec Codec) error {
+	switch codec {
+	case CodecJSON:
+		return json.Unmarshal(byteString, target)
+	case CodecGob:
+		return gob.NewDecoder(bytes.NewReader(byteString)).Decode(target)
+	case CodecRaw:
+		raw, ok := target.(*[]byte)
+		if !ok {
+			return fmt.Errorf("raw codec requires a byte slice")
+		}
+		*raw = byteString
+		return nil
+	default:
+		return fmt.Errorf("unknown codec")
+	}
+}
+
+// Encode message data, tagging it with its type name if a registry is in use
+func encodeData[T any](data T, codec Codec, registry *Registry) ([]byte, error) {
+	if registry != nil {
+		return registry.encode(data, codec)
+	}
+
+	return encodeObjectCodec(data, codec)
+}
+
+// Decode message data, using its type tag if a registry is in use
+func decodeData[T any](byteString []byte, codec Codec, registry *Registry) (T, error) {
+	if registry == nil {
+		return decodeObjectCodec[T](byteString, codec)
+	}
+
+	var data T
+	value, err := registry.decode(byteString, codec)
+	if err != nil {
+		return data, err
+	}
+
+	data, ok := value.(T)
+	if !ok {
+		return data, fmt.Errorf("%w: %T cannot be received as %s", ErrUnknownMessageType, value, reflect.TypeFor[T]())
+	}
+
+	return data, nil
+}
@@ -0,0 +1,101 @@
+package godtp
+
+import (
+	"reflect"
+	"sync"
+)
+
+// Message defines a message passing through interceptors or being routed to a handler
+type Message[R any] struct {
+	ClientID   uint
+	Type       string
+	Data       R
+	Unreliable bool
+	Headers    Headers
+}
+
+// Handler defines a function that handles a message
+type Handler[R any] func(message Message[R]) error
+
+// Middleware defines a function that wraps a handler, for example to log or filter messages
+type Middleware[R any] func(next Handler[R]) Handler[R]
+
+// Router dispatches received messages to handlers according to the messages' types. A server or client with a router
+// passes received messages to it rather than emitting receive events, and emits an error event when a handler fails.
+// Messages are routed on the goroutine that received them, so each handler should return promptly.
+type Router[R any] struct {
+	mutex      sync.RWMutex
+	handlers   map[reflect.Type]Handler[R]
+	middleware []Middleware[R]
+	fallback   Handler[R]
+}
+
+// NewRouter creates a new router with no handlers
+func NewRouter[R any]() *Router[R] {
+	return &Router[R]{
+		handlers: make(map[reflect.Type]Handler[R]),
+	}
+}
+
+// Handle registers a handler for messages of type T, replacing any existing handler for the type
+func Handle[T any, R any](router *Router[R], handler func(message Message[R], data T) error) {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+
+	router.handlers[reflect.TypeFor[T]()] = func(message Message[R]) error {
+		return handler(message, any(message.Data).(T))
+	}
+}
+
+// Use adds middleware that wraps every handler, including the fallback. Middleware added first runs first.
+func (router *Router[R]) Use(middleware ...Middleware[R]) {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+
+	router.middleware = append(router.middleware, middleware...)
+}
+
+// Fallback sets the handler for messages of types with no handler. Without a fallback, such messages are emitted as
+// receive events.
+func (router *Router[R]) Fallback(handler Handler[R]) {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+
+	router.fallback = handler
+}
+
+// Dispatch a message to its handler, returning whether a handler was found
+func (router *Router[R]) dispatch(message Message[R]) (bool, error) {
+	router.mutex.RLock()
+	handler, ok := router.handlers[reflect.TypeOf(any(message.Data))]
+	if !ok {
+		handler = router.fallback
+	}
+	middleware := router.middleware
+	router.mutex.RUnlock()
+
+	if handler == nil {
+		return false, nil
+	}
+
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+
+	return true, handler(message)
+}
+
+// Get the name of a message's type, preferring the name it is registered under
+func messageType(data any, registry *Registry) string {
+	if registry != nil {
+		if name, ok := registry.Name(data); ok {
+			return name
+		}
+	}
+
+	if data == nil {
+		return ""
+	}
+
+	return reflect.TypeOf(data).String()
+}
@@ -1,11 +1,20 @@
 package godtp
 
 import (
+	"cmp"
+	"crypto/rsa"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"net/netip"
+	"slices"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ServerEventType defines the type of server event
@@ -16,24 +25,115 @@ const (
 	ServerReceive ServerEventType = iota
 	ServerConnect
 	ServerDisconnect
+	ServerStream
+	ServerFileOffer
+	ServerFileProgress
+	ServerFileComplete
+	ServerError
+	ServerRateLimited
 )
 
 // ServerEvent defines an event emitted from the server
 type ServerEvent[T any] struct {
-	EventType ServerEventType
-	ClientID  uint
-	Data      T
+	EventType  ServerEventType
+	ClientID   uint
+	Data       T
+	Unreliable bool
+	Stream     *Stream
+	File       *FileTransfer
+	Err        error
+	Metadata   *Metadata
+	Headers    Headers
+}
+
+// A client connected to the server
+type serverClient struct {
+	id             uint
+	conn           net.Conn
+	key            []byte
+	settings       protocolSettings
+	datagram       *datagramSession
+	streams        *streamMux
+	writeMutex     fairMutex
+	limiter        *rateLimiter
+	metadata       *Metadata
+	connectedAt    time.Time
+	stats          connectionStats
+	log            *slog.Logger
+	maxMessageSize int
+}
+
+// Tell the client why it is being disconnected. The connection is closed afterwards by the caller.
+func (client *serverClient) close(reason string) {
+	frame, err := encodeFrame(frameHeader{kind: frameClose}, []byte(reason), false, 0)
+	if err != nil {
+		return
+	}
+
+	// Ignore write error, since the client is being disconnected anyway
+	client.conn.SetWriteDeadline(time.Now().Add(closeWriteTimeout))
+	client.write(frame)
+}
+
+// Encrypt a frame and write it to the client
+func (client *serverClient) write(frame []byte) error {
+	encryptedData, err := aeadEncrypt(client.key, frame)
+	if err != nil {
+		return err
+	}
+
+	err = checkMessageSize(encryptedData, client.maxMessageSize)
+	if err != nil {
+		return err
+	}
+
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+
+	n, err := client.conn.Write(encodeMessage(encryptedData))
+	client.stats.sentBytes(n)
+	return err
+}
+
+// Build a frame and write it to the client
+func (client *serverClient) writeFrame(header frameHeader, data []byte, threshold int) error {
+	compressing := client.settings.capabilities.Has(CapabilityCompression)
+	frame, err := encodeFrame(header, data, compressing, threshold)
+	if err != nil {
+		return err
+	}
+
+	return client.write(frame)
 }
 
 // Server defines the socket server type
 type Server[S any, R any] struct {
-	serving      bool
-	sock         net.Listener
-	clients      map[uint]net.Conn
-	keys         map[uint][]byte
-	eventChannel chan<- ServerEvent[R]
-	wg           sync.WaitGroup
-	nextClientID uint
+	serving          atomic.Bool
+	sock             net.Listener
+	datagramSock     *net.UDPConn
+	clients          map[uint]*serverClient
+	sessionIDs       map[uint64]uint
+	mutex            sync.RWMutex
+	config           protocolConfig
+	router           *Router[R]
+	acceptFilter     AcceptFilter
+	limits           ConnectionLimits
+	rateLimit        RateLimit
+	handshakes       map[net.Conn]struct{}
+	handshakeTimeout time.Duration
+	idleTimeout      time.Duration
+	acceptBucket     *tokenBucket
+	connections      int
+	connsPerIP       map[netip.Addr]int
+	validation       ValidationPolicy
+	validate         func(data R) error
+	inbound          interceptorChain[R]
+	outbound         interceptorChain[S]
+	metrics          metrics
+	logger           *slog.Logger
+	eventChannel     chan<- ServerEvent[R]
+	wg               sync.WaitGroup
+	nextClientID     uint
 }
 
 // NewServer creates a new socket server
@@ -41,17 +141,29 @@ func NewServer[S any, R any]() (*Server[S, R], <-chan ServerEvent[R]) {
 	eventChannel := make(chan ServerEvent[R], channelBufferSize)
 
 	return &Server[S, R]{
-		serving:      false,
-		clients:      make(map[uint]net.Conn),
-		keys:         make(map[uint][]byte),
-		eventChannel: eventChannel,
-		nextClientID: 0,
+		clients:          make(map[uint]*serverClient),
+		sessionIDs:       make(map[uint64]uint),
+		connsPerIP:       make(map[netip.Addr]int),
+		handshakes:       make(map[net.Conn]struct{}),
+		handshakeTimeout: defaultHandshakeTimeout,
+		config:           newProtocolConfig(),
+		logger:           discardLogger,
+		eventChannel:     eventChannel,
+		nextClientID:     0,
 	}, eventChannel
 }
 
+// NewRawServer creates a new server that sends and receives byte slices as-is, without encoding them. Clients using
+// the JSON codec are also accepted.
+func NewRawServer() (*Server[[]byte, []byte], <-chan ServerEvent[[]byte]) {
+	server, eventChannel := NewServer[[]byte, []byte]()
+	server.config.codecs = []Codec{CodecRaw, CodecJSON}
+	return server, eventChannel
+}
+
 // Start the server
 func (server *Server[S, R]) Start(host string, port uint16) error {
-	if server.serving {
+	if server.serving.Load() {
 		return fmt.Errorf("server is already serving")
 	}
 
@@ -60,119 +172,591 @@ func (server *Server[S, R]) Start(host string, port uint16) error {
 	if err != nil {
 		return err
 	}
+
+	err = server.Serve(ln)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	return nil
+}
+
+// Serve starts the server on an existing listener, such as an in-memory or wrapped listener. The server closes the
+// listener when it is stopped. Unreliable messages require a TCP listener, so the datagram socket can share its port.
+func (server *Server[S, R]) Serve(ln net.Listener) error {
+	if server.serving.Load() {
+		return fmt.Errorf("server is already serving")
+	}
+
+	if server.config.unreliable {
+		tcpAddr, ok := ln.Addr().(*net.TCPAddr)
+		if !ok {
+			return fmt.Errorf("unreliable messages require a TCP listener")
+		}
+
+		datagramSock, err := net.ListenUDP("udp", &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port})
+		if err != nil {
+			return err
+		}
+		server.datagramSock = datagramSock
+	}
 	server.sock = ln
 
-	server.serving = true
+	server.serving.Store(true)
 	server.wg.Add(1)
 	go server.serve()
+	server.logger.Info("server started", slog.Any("address", ln.Addr()))
+
+	if server.config.unreliable {
+		server.wg.Add(1)
+		go server.serveDatagrams()
+	}
 
 	return nil
 }
 
 // Stop the server
 func (server *Server[S, R]) Stop() error {
-	if !server.serving {
+	if !server.serving.Load() {
 		return fmt.Errorf("server is not serving")
 	}
 
-	server.serving = false
+	server.serving.Store(false)
 
+	server.mutex.RLock()
 	for _, client := range server.clients {
-		err := client.Close()
+		err := client.conn.Close()
 		if err != nil {
+			server.mutex.RUnlock()
 			return err
 		}
 	}
+	for conn := range server.handshakes {
+		// Ignore close error, since the handshake is being abandoned anyway
+		conn.Close()
+	}
+	server.mutex.RUnlock()
 	err := server.sock.Close()
 	if err != nil {
 		return err
 	}
+	if server.config.unreliable {
+		// The socket is left in place, so that concurrent sends fail with net.ErrClosed rather than racing
+		err = server.datagramSock.Close()
+		if err != nil {
+			return err
+		}
+	}
 
 	server.wg.Wait()
 	close(server.eventChannel)
+	server.logger.Info("server stopped")
 
 	return nil
 }
 
 // Send data to clients
 func (server *Server[S, R]) Send(data S, clientIDs ...uint) error {
-	if !server.serving {
+	return server.send(data, nil, clientIDs)
+}
+
+// SendWithMeta sends data to clients along with headers, such as a W3C traceparent or a request ID, which are carried
+// alongside the payload and exposed on the clients' receive events. Sending headers to a client that does not support
+// them fails with ErrHeadersUnsupported.
+func (server *Server[S, R]) SendWithMeta(data S, headers Headers, clientIDs ...uint) error {
+	return server.send(data, headers, clientIDs)
+}
+
+// Send data and headers to clients
+func (server *Server[S, R]) send(data S, headers Headers, clientIDs []uint) error {
+	if !server.serving.Load() {
 		return fmt.Errorf("server is not serving")
 	}
 
-	dataBytes, err := encodeObject(data)
+	clients, err := server.getClients(clientIDs)
 	if err != nil {
 		return err
 	}
 
-	if len(clientIDs) == 0 {
-		for clientID := range server.clients {
-			clientIDs = append(clientIDs, clientID)
+	interceptors := server.outbound.get()
+	frames := make(map[protocolSettings][]byte)
+	if len(interceptors) > 0 {
+		// Interceptors may transform the data differently for each client
+		frames = nil
+	}
+
+	for _, client := range clients {
+		message := server.outboundMessage(data, headers, client, false)
+		err = runInterceptors(interceptors, message, func(message Message[S]) error {
+			frame, err := server.encodeDataFrame(message.Data, message.Headers, client, frames)
+			if err != nil {
+				server.metrics.encodeErrors.Add(1)
+				return err
+			}
+
+			err = client.write(frame)
+			if err != nil {
+				return err
+			}
+
+			client.stats.sentMessage()
+			return nil
+		})
+		if err != nil {
+			return err
 		}
 	}
 
-	for _, clientID := range clientIDs {
-		if client, ok := server.clients[clientID]; ok {
-			encryptedData, err := aesEncrypt(server.keys[clientID], dataBytes)
+	return nil
+}
+
+// SendUnreliable sends data to clients over the unreliable datagram channel. Messages may be dropped, duplicated
+// messages are discarded, and clients without unreliable messages enabled are skipped.
+func (server *Server[S, R]) SendUnreliable(data S, clientIDs ...uint) error {
+	if !server.serving.Load() {
+		return fmt.Errorf("server is not serving")
+	}
+
+	if !server.config.unreliable {
+		return fmt.Errorf("unreliable messages are not enabled")
+	}
+
+	clients, err := server.getClients(clientIDs)
+	if err != nil {
+		return err
+	}
+
+	interceptors := server.outbound.get()
+	frames := make(map[protocolSettings][]byte)
+	if len(interceptors) > 0 {
+		// Interceptors may transform the data differently for each client
+		frames = nil
+	}
+
+	for _, client := range clients {
+		addr := client.datagram.getAddr()
+		if addr == nil {
+			continue
+		}
+
+		message := server.outboundMessage(data, nil, client, true)
+		err = runInterceptors(interceptors, message, func(message Message[S]) error {
+			frame, err := server.encodeDataFrame(message.Data, message.Headers, client, frames)
 			if err != nil {
+				server.metrics.encodeErrors.Add(1)
 				return err
 			}
 
-			size := encodeMessageSize(uint64(len(encryptedData)))
-			buffer := append(size, encryptedData...)
+			datagram, err := client.datagram.seal(datagramFromServer, datagramData, frame)
+			if err != nil {
+				return err
+			}
 
-			_, err = client.Write(buffer)
+			n, err := server.datagramSock.WriteToUDP(datagram, addr)
 			if err != nil {
 				return err
 			}
-		} else {
-			return fmt.Errorf("client does not exist")
+
+			client.stats.sentBytes(n)
+			client.stats.sentMessage()
+			return nil
+		})
+		if err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+// OpenStream opens a new stream to a client
+func (server *Server[S, R]) OpenStream(clientID uint) (*Stream, error) {
+	if !server.serving.Load() {
+		return nil, fmt.Errorf("server is not serving")
+	}
+
+	server.mutex.RLock()
+	client, ok := server.clients[clientID]
+	server.mutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("client does not exist")
+	}
+
+	return client.streams.open(streamGeneric)
+}
+
+// SendStream sends everything read from a reader to a client over a new stream, in bounded chunks rather than as a
+// single message held in memory. The client receives a ClientStream event whose stream can be read until io.EOF. This
+// blocks until the reader is exhausted and the stream is closed, pausing while the client has too much unread data.
+// It returns once the last of the data is written to the connection, which does not confirm the client received it.
+func (server *Server[S, R]) SendStream(reader io.Reader, clientID uint) error {
+	stream, err := server.OpenStream(clientID)
+	if err != nil {
+		return err
+	}
+
+	return copyToStream(stream, reader)
+}
+
+// SendFile offers a file to a client. The client receives a ServerFileOffer event, and once it accepts the offer the
+// file is sent in the background, reporting ServerFileProgress events and finally a ServerFileComplete event.
+func (server *Server[S, R]) SendFile(path string, clientID uint) (*FileTransfer, error) {
+	if !server.serving.Load() {
+		return nil, fmt.Errorf("server is not serving")
+	}
+
+	server.mutex.RLock()
+	client, ok := server.clients[clientID]
+	server.mutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("client does not exist")
+	}
+
+	stream, err := client.streams.open(streamFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return sendFile(stream, path, server.transferHooks(clientID))
+}
+
+// SetUnreliable sets whether the server accepts and sends unreliable messages over UDP. The datagram channel listens
+// on the same address as the server. This must be set before the server is started.
+func (server *Server[S, R]) SetUnreliable(enabled bool) error {
+	if server.serving.Load() {
+		return fmt.Errorf("server is already serving")
+	}
+
+	server.config.unreliable = enabled
+
+	return nil
+}
+
+// SetCompression sets whether messages are compressed. When enabled, messages to clients that also have compression
+// enabled are compressed if their encoded size is at least the threshold in bytes. This must be set before the server
+// is started.
+func (server *Server[S, R]) SetCompression(enabled bool, threshold int) error {
+	if server.serving.Load() {
+		return fmt.Errorf("server is already serving")
+	}
+
+	server.config.compression = enabled
+	server.config.compressionThreshold = threshold
+
+	return nil
+}
+
+// SetCodecs sets the codecs the server accepts messages in. Each client chooses from these codecs according to its own
+// preferences. This must be set before the server is started.
+func (server *Server[S, R]) SetCodecs(codecs ...Codec) error {
+	if server.serving.Load() {
+		return fmt.Errorf("server is already serving")
+	}
+
+	err := checkCodecs[S, R](codecs)
+	if err != nil {
+		return err
+	}
+
+	server.config.codecs = codecs
+
+	return nil
+}
+
+// SetRegistry sets the registry of message types the server sends and receives. Each message is tagged with its
+// registered type name, and received messages are decoded into their registered types, so S and R are typically
+// interfaces satisfied by every registered type. A message with an unknown type produces an error event. This must be
+// set before the server is started.
+func (server *Server[S, R]) SetRegistry(registry *Registry) error {
+	if server.serving.Load() {
+		return fmt.Errorf("server is already serving")
+	}
+
+	server.config.registry = registry
+
+	return nil
+}
+
+// SetAcceptFilter sets the filter that decides whether to accept each incoming connection. The filter runs before the
+// key exchange, so rejected connections cost little. This must be set before the server is started.
+func (server *Server[S, R]) SetAcceptFilter(filter AcceptFilter) error {
+	if server.serving.Load() {
+		return fmt.Errorf("server is already serving")
+	}
+
+	server.acceptFilter = filter
+
+	return nil
+}
+
+// SetLimits sets limits on the number of connected clients and the rate at which connections are accepted. Connections
+// over the limits are rejected with a reason before the key exchange. This must be set before the server is started.
+func (server *Server[S, R]) SetLimits(limits ConnectionLimits) error {
+	if server.serving.Load() {
+		return fmt.Errorf("server is already serving")
+	}
+
+	server.limits = limits
+	server.acceptBucket = nil
+	if limits.AcceptRate > 0 {
+		server.acceptBucket = newTokenBucket(limits.AcceptRate, limits.AcceptBurst)
+	}
+
+	return nil
+}
+
+// SetRateLimit sets the limit on the messages each client can send, and what happens to messages over the limit. The
+// first message over the limit after a client was within it produces a rate limited event. Unreliable messages over the
+// limit are dropped rather than delayed. This must be set before the server is started.
+func (server *Server[S, R]) SetRateLimit(limit RateLimit) error {
+	if server.serving.Load() {
+		return fmt.Errorf("server is already serving")
+	}
+
+	server.rateLimit = limit
+
+	return nil
+}
+
+// SetHandshakeTimeout sets how long a new connection has to complete the key exchange, once the server has generated
+// its keys, before it is closed. A timeout of 0 disables the limit. The default is 10 seconds. This must be set before
+// the server is started.
+func (server *Server[S, R]) SetHandshakeTimeout(timeout time.Duration) error {
+	if server.serving.Load() {
+		return fmt.Errorf("server is already serving")
+	}
+
+	server.handshakeTimeout = timeout
+
+	return nil
+}
+
+// SetIdleTimeout sets how long a client can go without sending anything other than heartbeats before it is
+// disconnected. The client is told the reason, and the disconnect event carries ErrIdleTimeout. A timeout of 0, the
+// default, disables the limit. This must be set before the server is started.
+func (server *Server[S, R]) SetIdleTimeout(timeout time.Duration) error {
+	if server.serving.Load() {
+		return fmt.Errorf("server is already serving")
+	}
+
+	server.idleTimeout = timeout
+
+	return nil
+}
+
+// SetLogger sets the logger that server lifecycle events, rejected connections, failed handshakes, protocol errors and
+// disconnect reasons are logged to. Records about a client carry its ID and remote address. Nothing is logged by
+// default, and a nil logger disables logging again. This must be set before the server is started.
+func (server *Server[S, R]) SetLogger(logger *slog.Logger) error {
+	if server.serving.Load() {
+		return fmt.Errorf("server is already serving")
+	}
+
+	server.logger = loggerOrDiscard(logger)
+
+	return nil
+}
+
+// SetValidation sets what happens when a client sends a message that cannot be decoded or fails validation. Messages
+// are validated with their Validate method if their type implements Validator, and then with the given validation
+// function, if it is not nil. Invalid messages produce an error event wrapping ErrInvalidMessage, and under
+// ValidationDisconnect the connection is then closed. This must be set before the server is started.
+func (server *Server[S, R]) SetValidation(policy ValidationPolicy, validate func(data R) error) error {
+	if server.serving.Load() {
+		return fmt.Errorf("server is already serving")
+	}
+
+	server.validation = policy
+	server.validate = validate
+
+	return nil
+}
+
+// InterceptInbound adds interceptors that run on each message received from a client, before it is routed or emitted.
+// A message rejected by an interceptor is dropped and produces an error event.
+func (server *Server[S, R]) InterceptInbound(interceptors ...Interceptor[R]) {
+	server.inbound.add(interceptors...)
+}
+
+// InterceptOutbound adds interceptors that run on each message sent to a client, before it is encoded. Messages sent to
+// several clients pass through the interceptors once per client, and a message rejected by an interceptor fails the
+// send with the interceptor's error.
+func (server *Server[S, R]) InterceptOutbound(interceptors ...Interceptor[S]) {
+	server.outbound.add(interceptors...)
+}
+
+// SetRouter sets the router that messages received from clients are dispatched to. Messages the router has no handler
+// for are emitted as receive events, and handler errors are emitted as error events. This must be set before the
+// server is started.
+func (server *Server[S, R]) SetRouter(router *Router[R]) error {
+	if server.serving.Load() {
+		return fmt.Errorf("server is already serving")
+	}
+
+	server.router = router
+
+	return nil
+}
+
+// SetHeartbeat sets the interval at which heartbeats are sent to clients that also have heartbeats enabled. A client
+// that sends nothing for several intervals is disconnected. An interval of 0 disables heartbeats. This must be set
+// before the server is started.
+func (server *Server[S, R]) SetHeartbeat(interval time.Duration) error {
+	if server.serving.Load() {
+		return fmt.Errorf("server is already serving")
+	}
+
+	server.config.heartbeat = interval
+
+	return nil
+}
+
+// SetMaxStreams sets how many streams each client can have open to the server at once. A client opening more is
+// disconnected with ErrTooManyStreams. A limit of 0 disables the limit. The default is 256. This must be set before the
+// server is started.
+func (server *Server[S, R]) SetMaxStreams(limit int) error {
+	if server.serving.Load() {
+		return fmt.Errorf("server is already serving")
+	}
+
+	server.config.maxStreams = limit
+
+	return nil
+}
+
+// SetMaxMessageSize sets the maximum size of a message sent or received, in bytes, once encrypted or decompressed.
+// Sending a larger message fails with ErrMessageTooLarge, and a client sending one is disconnected. A size of 0
+// disables the limit. The default is 64 MiB. This must be set before the server is started.
+func (server *Server[S, R]) SetMaxMessageSize(size int) error {
+	if server.serving.Load() {
+		return fmt.Errorf("server is already serving")
+	}
+
+	server.config.maxMessageSize = size
+
+	return nil
+}
+
 // Serving returns a boolean value representing whether the server is serving
 func (server *Server[S, R]) Serving() bool {
-	return server.serving
+	return server.serving.Load()
 }
 
 // GetAddr returns the server's address
 func (server *Server[S, R]) GetAddr() (string, uint16, error) {
-	if !server.serving {
+	if !server.serving.Load() {
 		return "", 0, fmt.Errorf("server is not serving")
 	}
 
 	return parseAddr(server.sock.Addr().String())
 }
 
+// Clients returns a snapshot of the state of every connected client
+func (server *Server[S, R]) Clients() []ClientInfo {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+
+	clients := make([]ClientInfo, 0, len(server.clients))
+	for _, client := range server.clients {
+		clients = append(clients, client.info())
+	}
+
+	slices.SortFunc(clients, func(a, b ClientInfo) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	return clients
+}
+
+// ClientCount returns the number of connected clients
+func (server *Server[S, R]) ClientCount() int {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+
+	return len(server.clients)
+}
+
+// Metadata returns the metadata store of a client
+func (server *Server[S, R]) Metadata(clientID uint) (*Metadata, error) {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+
+	client, ok := server.clients[clientID]
+	if !ok {
+		return nil, fmt.Errorf("client does not exist")
+	}
+
+	return client.metadata, nil
+}
+
+// Stats returns a snapshot of the server's metrics. Traffic totals include clients that have since disconnected.
+func (server *Server[S, R]) Stats() ServerStats {
+	server.mutex.RLock()
+	clientsConnected := len(server.clients)
+	handshakesInProgress := len(server.handshakes)
+	server.mutex.RUnlock()
+
+	return ServerStats{
+		ConnectionsAccepted:  server.metrics.connectionsAccepted.Load(),
+		ConnectionsRejected:  server.metrics.connectionsRejected.Load(),
+		HandshakesFailed:     server.metrics.handshakesFailed.Load(),
+		HandshakesInProgress: handshakesInProgress,
+		ClientsConnected:     clientsConnected,
+		MessagesSent:         server.metrics.traffic.messagesOut.Load(),
+		MessagesReceived:     server.metrics.traffic.messagesIn.Load(),
+		BytesSent:            server.metrics.traffic.bytesOut.Load(),
+		BytesReceived:        server.metrics.traffic.bytesIn.Load(),
+		EncodeErrors:         server.metrics.encodeErrors.Load(),
+		DecodeErrors:         server.metrics.decodeErrors.Load(),
+		DecryptErrors:        server.metrics.decryptErrors.Load(),
+		EventQueueDepth:      len(server.eventChannel),
+		HandshakeLatency:     server.metrics.handshakeLatency.snapshot(),
+	}
+}
+
+// PublishExpvar publishes the server's metrics as an expvar variable with the given name, which is served at
+// /debug/vars by the default HTTP mux. Names can only be published once per process.
+func (server *Server[S, R]) PublishExpvar(name string) error {
+	return publishExpvar(name, func() any {
+		return server.Stats()
+	})
+}
+
 // GetClientAddr returns a client's address
 func (server *Server[S, R]) GetClientAddr(clientID uint) (string, uint16, error) {
-	if !server.serving {
+	if !server.serving.Load() {
 		return "", 0, fmt.Errorf("server is not serving")
 	}
 
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+
 	if client, ok := server.clients[clientID]; ok {
-		return parseAddr(client.RemoteAddr().String())
+		return parseAddr(client.conn.RemoteAddr().String())
 	}
 	return "", 0, fmt.Errorf("client does not exist")
 }
 
 // RemoveClient disconnects a client from the server
 func (server *Server[S, R]) RemoveClient(clientID uint) error {
-	if !server.serving {
+	if !server.serving.Load() {
 		return fmt.Errorf("server is not serving")
 	}
 
-	if client, ok := server.clients[clientID]; ok {
-		err := client.Close()
+	server.mutex.RLock()
+	client, ok := server.clients[clientID]
+	server.mutex.RUnlock()
+
+	if ok {
+		err := client.conn.Close()
 		if err != nil {
 			return err
 		}
 
-		delete(server.clients, clientID)
-		delete(server.keys, clientID)
+		server.deleteClient(clientID)
 
 		return nil
 	}
@@ -185,30 +769,73 @@ func (server *Server[S, R]) serve() {
 		server.wg.Done()
 	}()
 
-	for server.serving {
+	for server.serving.Load() {
 		conn, err := server.sock.Accept()
 		if err != nil {
-			if !server.serving {
+			if !server.serving.Load() {
 				break
 			} else {
 				continue
 			}
 		}
 
-		clientID := server.newClientID()
-		err = server.exchangeKeys(clientID, conn)
-		if err != nil {
-			if !server.serving {
-				break
-			} else {
+		metadata := newMetadata()
+		if server.acceptFilter != nil {
+			err = server.acceptFilter(ConnectionInfo{RemoteAddr: conn.RemoteAddr(), Metadata: metadata})
+			if err != nil {
+				server.reject(conn, err.Error())
 				continue
 			}
 		}
 
-		server.clients[clientID] = conn
+		err = server.admit(conn)
+		if err != nil {
+			server.reject(conn, err.Error())
+			continue
+		}
+		server.metrics.connectionsAccepted.Add(1)
+
+		// Track the handshake before it starts, so that a stopping server either closes it or never starts it
+		server.mutex.Lock()
+		if !server.serving.Load() {
+			server.mutex.Unlock()
+			// Ignore socket close error
+			conn.Close()
+			server.release(conn)
+			break
+		}
+		server.handshakes[conn] = struct{}{}
 		server.wg.Add(1)
-		go server.serveClient(clientID)
+		server.mutex.Unlock()
+
+		clientID := server.newClientID()
+		go server.handshake(clientID, conn, metadata)
+	}
+}
+
+// Complete the key exchange with a new connection, then serve the client
+func (server *Server[S, R]) handshake(clientID uint, conn net.Conn, metadata *Metadata) {
+	start := time.Now()
+
+	err := server.exchangeKeys(clientID, conn, metadata)
+
+	server.mutex.Lock()
+	delete(server.handshakes, conn)
+	server.mutex.Unlock()
+
+	if err != nil {
+		server.metrics.handshakesFailed.Add(1)
+		clientLogger(server.logger, clientID, conn.RemoteAddr()).Warn("handshake failed", slog.Any("error", err))
+		// Ignore socket close error
+		conn.Close()
+		server.release(conn)
+		server.wg.Done()
+		return
 	}
+	server.metrics.handshakeLatency.observe(time.Since(start))
+
+	conn.SetDeadline(time.Time{})
+	server.serveClient(clientID)
 }
 
 // Serve clients
@@ -217,49 +844,436 @@ func (server *Server[S, R]) serveClient(clientID uint) {
 		server.wg.Done()
 	}()
 
-	server.eventChannel <- ServerEvent[R]{
+	server.emit(ServerEvent[R]{
 		EventType: ServerConnect,
 		ClientID:  clientID,
-	}
+	})
+	server.mutex.RLock()
+	client := server.clients[clientID]
+	server.mutex.RUnlock()
+
+	client.log.Info("client connected",
+		slog.Uint64("version", uint64(client.settings.version)),
+		slog.String("codec", client.settings.codec.String()),
+		slog.Bool("unreliable", client.datagram != nil))
+
+	// The error reported in the disconnect event, and the reason the connection ended, which is only logged
+	var disconnectErr, reason error
 	defer func() {
-		server.eventChannel <- ServerEvent[R]{
+		// Ignore close error, since the connection may already be closed
+		client.conn.Close()
+		client.streams.close(fmt.Errorf("connection closed"))
+		server.deleteClient(clientID)
+		server.release(client.conn)
+
+		if disconnectErr != nil {
+			reason = disconnectErr
+		}
+		logDisconnect(client.log, "client disconnected", reason)
+
+		server.emit(ServerEvent[R]{
 			EventType: ServerDisconnect,
 			ClientID:  clientID,
-		}
+			Err:       disconnectErr,
+			Metadata:  client.metadata,
+		})
 	}()
 
-	client := server.clients[clientID]
+	readTimeout := client.settings.readTimeout()
+	if client.settings.capabilities.Has(CapabilityHeartbeat) {
+		done := make(chan struct{})
+		defer close(done)
+		go sendHeartbeats(client.settings.heartbeat, done, client.write)
+	}
 
-	sizeBuffer := make([]byte, lenSize)
+	for server.serving.Load() {
+		deadline := time.Time{}
+		if readTimeout > 0 {
+			deadline = time.Now().Add(readTimeout)
+		}
+		if server.idleTimeout > 0 {
+			idleDeadline := client.stats.lastActivity().Add(server.idleTimeout)
+			if deadline.IsZero() || idleDeadline.Before(deadline) {
+				deadline = idleDeadline
+			}
+		}
+		if !deadline.IsZero() {
+			client.conn.SetReadDeadline(deadline)
+		}
 
-	for server.serving {
-		_, err := client.Read(sizeBuffer)
+		buffer, err := readMessage(client.conn, server.config.maxMessageSize)
 		if err != nil {
+			if server.idleTimeout > 0 && time.Since(client.stats.lastActivity()) >= server.idleTimeout {
+				disconnectErr = ErrIdleTimeout
+				client.close(ErrIdleTimeout.Error())
+			}
+			reason = err
 			break
 		}
+		client.stats.receivedBytes(lenSize + len(buffer))
 
-		msgSize := decodeMessageSize(sizeBuffer)
-		buffer := make([]byte, msgSize)
-		_, err = client.Read(buffer)
+		frame, err := aeadDecrypt(client.key, buffer)
 		if err != nil {
+			server.metrics.decryptErrors.Add(1)
+			reason = fmt.Errorf("failed to decrypt message: %w", err)
 			break
 		}
 
-		dataBytes, err := aesDecrypt(server.keys[clientID], buffer)
+		header, dataBytes, err := decodeFrame(frame, server.config.maxMessageSize)
 		if err != nil {
+			reason = fmt.Errorf("malformed frame: %w", err)
 			break
 		}
 
-		data, err := decodeObject[R](dataBytes)
+		if header.kind != framePing && header.kind != framePong {
+			client.stats.active()
+		}
+
+		if isStreamFrame(header.kind) {
+			if header.kind == frameStreamData && client.limiter != nil {
+				wait, exceeded := server.limitStreamRate(client, len(dataBytes))
+				if exceeded {
+					reason = ErrRateLimited
+					break
+				}
+				time.Sleep(wait)
+			}
+
+			err = client.streams.handle(header, dataBytes)
+			if err != nil {
+				if errors.Is(err, ErrTooManyStreams) {
+					disconnectErr = ErrTooManyStreams
+					client.close(ErrTooManyStreams.Error())
+				}
+				reason = fmt.Errorf("stream error: %w", err)
+				break
+			}
+			continue
+		}
+
+		if header.kind != frameData {
+			continue
+		}
+		client.stats.receivedMessage()
+
+		if client.limiter != nil {
+			wait, exceeded := server.limitRate(client, len(dataBytes), false)
+			if exceeded {
+				if client.limiter.action == RateLimitDisconnect {
+					reason = ErrRateLimited
+					break
+				}
+				continue
+			}
+			time.Sleep(wait)
+		}
+
+		data, err := decodeValidData(dataBytes, client.settings.codec, server.config.registry, server.validate)
 		if err != nil {
+			server.metrics.decodeErrors.Add(1)
+			client.log.Warn("invalid message", slog.Any("error", err))
+			server.emit(ServerEvent[R]{
+				EventType: ServerError,
+				ClientID:  clientID,
+				Err:       err,
+			})
+			if errors.Is(err, ErrUnknownMessageType) || server.validation == ValidationSkip {
+				continue
+			}
+			reason = err
 			break
 		}
 
-		server.eventChannel <- ServerEvent[R]{
-			EventType: ServerReceive,
-			ClientID:  clientID,
-			Data:      data,
+		server.receive(clientID, data, header.headers, false)
+	}
+}
+
+// Handle datagrams from clients
+func (server *Server[S, R]) serveDatagrams() {
+	defer func() {
+		server.wg.Done()
+	}()
+
+	datagramSock := server.datagramSock
+	buffer := make([]byte, maxDatagramSize)
+
+	for server.serving.Load() {
+		n, addr, err := datagramSock.ReadFromUDP(buffer)
+		if err != nil {
+			if !server.serving.Load() {
+				break
+			} else {
+				continue
+			}
+		}
+
+		sessionID, ok := datagramSessionID(buffer[:n])
+		if !ok {
+			continue
+		}
+
+		server.mutex.RLock()
+		clientID, ok := server.sessionIDs[sessionID]
+		client := server.clients[clientID]
+		server.mutex.RUnlock()
+		if !ok || client == nil {
+			continue
+		}
+
+		kind, frame, err := client.datagram.open(datagramFromClient, buffer[:n])
+		if err != nil {
+			server.metrics.decryptErrors.Add(1)
+			client.log.Debug("failed to open datagram", slog.Any("error", err))
+			continue
 		}
+		client.stats.receivedBytes(n)
+
+		client.datagram.setAddr(addr)
+
+		if kind == datagramRegister {
+			// Acknowledge every registration, since the client retries until one arrives
+			ack, err := client.datagram.seal(datagramFromServer, datagramRegister, []byte{})
+			if err == nil {
+				datagramSock.WriteToUDP(ack, addr)
+			}
+			continue
+		}
+
+		if kind != datagramData {
+			continue
+		}
+
+		header, dataBytes, err := decodeFrame(frame, server.config.maxMessageSize)
+		if err != nil || header.kind != frameData {
+			continue
+		}
+		client.stats.active()
+		client.stats.receivedMessage()
+
+		if client.limiter != nil {
+			_, exceeded := server.limitRate(client, len(dataBytes), true)
+			if exceeded {
+				if client.limiter.action == RateLimitDisconnect {
+					// Ignore close error, since the client is being disconnected anyway
+					client.conn.Close()
+				}
+				continue
+			}
+		}
+
+		data, err := decodeValidData(dataBytes, client.settings.codec, server.config.registry, server.validate)
+		if err != nil {
+			server.metrics.decodeErrors.Add(1)
+			// Invalid datagrams are always dropped, since the connection does not depend on them
+			client.log.Warn("invalid message", slog.Bool("unreliable", true), slog.Any("error", err))
+			server.emit(ServerEvent[R]{
+				EventType:  ServerError,
+				ClientID:   clientID,
+				Unreliable: true,
+				Err:        err,
+			})
+			continue
+		}
+
+		server.receive(clientID, data, header.headers, true)
+	}
+}
+
+// Emit an event, attaching the metadata of the client it concerns if it has any
+func (server *Server[S, R]) emit(event ServerEvent[R]) {
+	if event.Metadata == nil {
+		server.mutex.RLock()
+		if client, ok := server.clients[event.ClientID]; ok {
+			event.Metadata = client.metadata
+		}
+		server.mutex.RUnlock()
+	}
+
+	server.eventChannel <- event
+}
+
+// Apply a client's rate limit to a message, reporting the client if it has started exceeding the limit. Returns how
+// long to wait before handling the message, and whether the message is over the limit and should not be handled.
+func (server *Server[S, R]) limitRate(client *serverClient, size int, unreliable bool) (time.Duration, bool) {
+	wait, exceeded, violation := client.limiter.limit(size, !unreliable)
+	server.reportRateLimit(client, violation, unreliable)
+
+	return wait, exceeded
+}
+
+// Apply a client's rate limit to stream data, reporting the client if it has started exceeding the limit
+func (server *Server[S, R]) limitStreamRate(client *serverClient, size int) (time.Duration, bool) {
+	wait, exceeded, violation := client.limiter.limitStream(size)
+	server.reportRateLimit(client, violation, false)
+
+	return wait, exceeded
+}
+
+// Report a client that has started exceeding its rate limit
+func (server *Server[S, R]) reportRateLimit(client *serverClient, violation bool, unreliable bool) {
+	if violation {
+		client.log.Warn("rate limit exceeded", slog.Bool("unreliable", unreliable))
+		server.emit(ServerEvent[R]{
+			EventType:  ServerRateLimited,
+			ClientID:   client.id,
+			Unreliable: unreliable,
+			Err:        ErrRateLimited,
+		})
+	}
+}
+
+// Pass a message received from a client through the inbound interceptors, then route or emit it
+func (server *Server[S, R]) receive(clientID uint, data R, headers Headers, unreliable bool) {
+	message := Message[R]{
+		ClientID:   clientID,
+		Type:       messageType(data, server.config.registry),
+		Data:       data,
+		Unreliable: unreliable,
+		Headers:    headers,
+	}
+
+	err := runInterceptors(server.inbound.get(), message, server.deliver)
+	if err != nil {
+		server.emit(ServerEvent[R]{
+			EventType:  ServerError,
+			ClientID:   clientID,
+			Data:       data,
+			Unreliable: unreliable,
+			Err:        err,
+			Headers:    headers,
+		})
+	}
+}
+
+// Route a message received from a client, or emit it if it is not handled. Handler errors are emitted rather than
+// returned, so they are not mistaken for rejections by interceptors.
+func (server *Server[S, R]) deliver(message Message[R]) error {
+	if server.router != nil {
+		handled, err := server.router.dispatch(message)
+		if err != nil {
+			server.emit(ServerEvent[R]{
+				EventType:  ServerError,
+				ClientID:   message.ClientID,
+				Data:       message.Data,
+				Unreliable: message.Unreliable,
+				Err:        err,
+				Headers:    message.Headers,
+			})
+		}
+		if handled {
+			return nil
+		}
+	}
+
+	server.emit(ServerEvent[R]{
+		EventType:  ServerReceive,
+		ClientID:   message.ClientID,
+		Data:       message.Data,
+		Unreliable: message.Unreliable,
+		Headers:    message.Headers,
+	})
+
+	return nil
+}
+
+// Build the message passed to outbound interceptors for data sent to a client
+func (server *Server[S, R]) outboundMessage(data S, headers Headers, client *serverClient, unreliable bool) Message[S] {
+	return Message[S]{
+		ClientID:   client.id,
+		Type:       messageType(data, server.config.registry),
+		Data:       data,
+		Unreliable: unreliable,
+		Headers:    headers.Clone(),
+	}
+}
+
+// Get the clients with the given IDs, or every client if no IDs are given
+func (server *Server[S, R]) getClients(clientIDs []uint) ([]*serverClient, error) {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+
+	if len(clientIDs) == 0 {
+		for clientID := range server.clients {
+			clientIDs = append(clientIDs, clientID)
+		}
+	}
+
+	clients := make([]*serverClient, 0, len(clientIDs))
+	for _, clientID := range clientIDs {
+		client, ok := server.clients[clientID]
+		if !ok {
+			return nil, fmt.Errorf("client does not exist")
+		}
+		clients = append(clients, client)
+	}
+
+	return clients, nil
+}
+
+// Remove a client's state from the server
+func (server *Server[S, R]) deleteClient(clientID uint) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if client, ok := server.clients[clientID]; ok && client.datagram != nil {
+		delete(server.sessionIDs, client.datagram.id)
+	}
+
+	delete(server.clients, clientID)
+}
+
+// Encode data and build the plaintext of a data frame for a client, reusing frames already built for clients with the
+// same settings when given a frame cache
+func (server *Server[S, R]) encodeDataFrame(data S, headers Headers, client *serverClient, frames map[protocolSettings][]byte) ([]byte, error) {
+	if len(headers) > 0 && !client.settings.capabilities.Has(CapabilityHeaders) {
+		return []byte{}, ErrHeadersUnsupported
+	}
+
+	if frame, ok := frames[client.settings]; ok {
+		return frame, nil
+	}
+
+	dataBytes, err := encodeData(data, client.settings.codec, server.config.registry)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	compressing := client.settings.capabilities.Has(CapabilityCompression)
+	header := frameHeader{kind: frameData, headers: headers}
+	frame, err := encodeFrame(header, dataBytes, compressing, server.config.compressionThreshold)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if frames != nil {
+		frames[client.settings] = frame
+	}
+	return frame, nil
+}
+
+// Get the hooks file transfers with a client use to report events
+func (server *Server[S, R]) transferHooks(clientID uint) transferHooks {
+	eventTypes := map[fileEvent]ServerEventType{
+		fileOffered:  ServerFileOffer,
+		fileProgress: ServerFileProgress,
+		fileComplete: ServerFileComplete,
+	}
+
+	return transferHooks{
+		emit: func(event fileEvent, transfer *FileTransfer) {
+			server.emit(ServerEvent[R]{
+				EventType: eventTypes[event],
+				ClientID:  clientID,
+				File:      transfer,
+			})
+		},
+		spawn: func(f func()) {
+			server.wg.Add(1)
+			go func() {
+				defer server.wg.Done()
+				f()
+			}()
+		},
 	}
 }
 
@@ -269,39 +1283,187 @@ func (server *Server[S, R]) newClientID() uint {
 	return server.nextClientID - 1
 }
 
-// Exchange crypto keys with a client
-func (server *Server[S, R]) exchangeKeys(clientID uint, client net.Conn) error {
+// Check a new connection against the connection limits, counting it towards them if it is admitted
+func (server *Server[S, R]) admit(conn net.Conn) error {
+	if server.acceptBucket != nil && !server.acceptBucket.allow() {
+		return fmt.Errorf("too many connection attempts")
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.limits.MaxClients > 0 && server.connections >= server.limits.MaxClients {
+		return fmt.Errorf("server is full")
+	}
+
+	ip, ok := remoteIP(conn.RemoteAddr())
+	if ok && server.limits.MaxClientsPerIP > 0 && server.connsPerIP[ip] >= server.limits.MaxClientsPerIP {
+		return fmt.Errorf("too many connections from address")
+	}
+
+	server.connections++
+	if ok {
+		server.connsPerIP[ip]++
+	}
+
+	return nil
+}
+
+// Stop counting a closed connection towards the connection limits
+func (server *Server[S, R]) release(conn net.Conn) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.connections--
+	if ip, ok := remoteIP(conn.RemoteAddr()); ok {
+		server.connsPerIP[ip]--
+		if server.connsPerIP[ip] <= 0 {
+			delete(server.connsPerIP, ip)
+		}
+	}
+}
+
+// Tell a client its connection was rejected, then close the connection
+func (server *Server[S, R]) reject(conn net.Conn, reason string) {
+	server.metrics.connectionsRejected.Add(1)
+	server.logger.Info("connection rejected", slog.Any("remote_addr", conn.RemoteAddr()), slog.String("reason", reason))
+
+	hello := serverHello{
+		Versions: supportedVersions,
+		Error:    reason,
+	}
+
+	// Ignore write and close errors, since the connection is being refused anyway. The write deadline keeps a client
+	// that never reads from holding up the accept loop.
+	conn.SetWriteDeadline(time.Now().Add(closeWriteTimeout))
+	gob.NewEncoder(conn).Encode(&hello)
+	conn.Close()
+}
+
+// Exchange crypto keys and negotiate protocol settings with a client
+func (server *Server[S, R]) exchangeKeys(clientID uint, conn net.Conn, metadata *Metadata) error {
 	privateKey, err := newRSAKeys()
 	if err != nil {
 		return err
 	}
 
-	pub := privateKey.PublicKey
-	enc := gob.NewEncoder(client)
-	err = enc.Encode(&pub)
+	// Start the handshake deadline once the keys are ready, so slow key generation is not blamed on the client
+	if server.handshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(server.handshakeTimeout))
+	}
+
+	return server.exchangeKeysWith(privateKey, clientID, conn, metadata)
+}
+
+// Exchange crypto keys and negotiate protocol settings with a client, using an existing RSA key pair
+func (server *Server[S, R]) exchangeKeysWith(privateKey *rsa.PrivateKey, clientID uint, conn net.Conn, metadata *Metadata) error {
+	hello := server.config.hello(privateKey.PublicKey)
+	enc := gob.NewEncoder(conn)
+	err := enc.Encode(&hello)
 	if err != nil {
 		return err
 	}
 
-	sizeBuffer := make([]byte, lenSize)
-	_, err = client.Read(sizeBuffer)
+	encryptedKey, err := readMessageLimit(conn, maxHandshakeSize)
 	if err != nil {
 		return err
 	}
 
-	msgSize := decodeMessageSize(sizeBuffer)
-	buffer := make([]byte, msgSize)
-	_, err = client.Read(buffer)
+	key, err := rsaDecrypt(privateKey, encryptedKey)
 	if err != nil {
 		return err
 	}
+	if len(key) != aesKeySize {
+		return fmt.Errorf("invalid key size %d", len(key))
+	}
 
-	key, err := rsaDecrypt(privateKey, buffer)
+	encryptedChoice, err := readMessageLimit(conn, maxHandshakeSize)
 	if err != nil {
 		return err
 	}
 
-	server.keys[clientID] = key
+	choiceBytes, err := aeadDecrypt(key, encryptedChoice)
+	if err != nil {
+		return err
+	}
+
+	choice := clientHello{}
+	err = decodeHandshake(choiceBytes, &choice)
+	if err != nil {
+		return err
+	}
+
+	settings, acceptErr := server.config.accept(choice)
+	accept := serverAccept{}
+	if acceptErr != nil {
+		accept.Error = acceptErr.Error()
+	}
+
+	acceptBytes, err := encodeHandshake(&accept)
+	if err != nil {
+		return err
+	}
+
+	encryptedAccept, err := aeadEncrypt(key, acceptBytes)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(encodeMessage(encryptedAccept))
+	if err != nil {
+		return err
+	}
+
+	if acceptErr != nil {
+		return fmt.Errorf("%w: %v", ErrIncompatiblePeer, acceptErr)
+	}
+
+	client := &serverClient{
+		id:             clientID,
+		conn:           conn,
+		key:            key,
+		settings:       settings,
+		writeMutex:     newFairMutex(),
+		limiter:        newRateLimiter(server.rateLimit),
+		metadata:       metadata,
+		connectedAt:    time.Now(),
+		maxMessageSize: server.config.maxMessageSize,
+	}
+	client.stats.totals = &server.metrics.traffic
+	client.log = clientLogger(server.logger, clientID, conn.RemoteAddr())
+	client.stats.active()
+	client.streams = newStreamMux(false, server.config.maxStreams, func(header frameHeader, data []byte) error {
+		return client.writeFrame(header, data, server.config.compressionThreshold)
+	}, func(stream *Stream) {
+		if stream.kind == streamFile {
+			hooks := server.transferHooks(clientID)
+			hooks.spawn(func() {
+				receiveFileOffer(stream, hooks)
+			})
+			return
+		}
+
+		server.emit(ServerEvent[R]{
+			EventType: ServerStream,
+			ClientID:  clientID,
+			Stream:    stream,
+		})
+	})
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.config.unreliable && settings.capabilities.Has(CapabilityDatagrams) {
+		session, err := newDatagramSession(key)
+		if err != nil {
+			return err
+		}
+
+		client.datagram = session
+		server.sessionIDs[session.id] = clientID
+	}
+
+	server.clients[clientID] = client
 
 	return nil
 }
@@ -0,0 +1,128 @@
+package godtp
+
+import (
+	"expvar"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// The number of bounded handshake latency histogram buckets
+const latencyBuckets = 12
+
+// The upper bounds of the handshake latency histogram buckets
+var latencyBounds = [latencyBuckets]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// LatencyHistogram defines a snapshot of a latency distribution. Counts[i] is the number of samples no greater than
+// Bounds[i] and greater than any lower bound, and the final count is the number of samples greater than every bound.
+type LatencyHistogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+// ServerStats defines a snapshot of a server's metrics
+type ServerStats struct {
+	ConnectionsAccepted  uint64
+	ConnectionsRejected  uint64
+	HandshakesFailed     uint64
+	HandshakesInProgress int
+	ClientsConnected     int
+	MessagesSent         uint64
+	MessagesReceived     uint64
+	BytesSent            uint64
+	BytesReceived        uint64
+	EncodeErrors         uint64
+	DecodeErrors         uint64
+	DecryptErrors        uint64
+	EventQueueDepth      int
+	HandshakeLatency     LatencyHistogram
+}
+
+// ClientStats defines a snapshot of a client's metrics
+type ClientStats struct {
+	Connected        bool
+	HandshakesFailed uint64
+	MessagesSent     uint64
+	MessagesReceived uint64
+	BytesSent        uint64
+	BytesReceived    uint64
+	EncodeErrors     uint64
+	DecodeErrors     uint64
+	DecryptErrors    uint64
+	EventQueueDepth  int
+	HandshakeLatency LatencyHistogram
+}
+
+// A histogram of latencies that can be updated concurrently
+type latencyHistogram struct {
+	counts [latencyBuckets + 1]atomic.Uint64
+	count  atomic.Uint64
+	sum    atomic.Int64
+}
+
+// Record a latency
+func (histogram *latencyHistogram) observe(latency time.Duration) {
+	bucket := len(latencyBounds)
+	for i, bound := range latencyBounds {
+		if latency <= bound {
+			bucket = i
+			break
+		}
+	}
+
+	histogram.counts[bucket].Add(1)
+	histogram.count.Add(1)
+	histogram.sum.Add(int64(latency))
+}
+
+// Get a snapshot of the histogram
+func (histogram *latencyHistogram) snapshot() LatencyHistogram {
+	counts := make([]uint64, len(histogram.counts))
+	for i := range histogram.counts {
+		counts[i] = histogram.counts[i].Load()
+	}
+
+	return LatencyHistogram{
+		Bounds: append([]time.Duration(nil), latencyBounds[:]...),
+		Counts: counts,
+		Count:  histogram.count.Load(),
+		Sum:    time.Duration(histogram.sum.Load()),
+	}
+}
+
+// The metrics shared by servers and clients
+type metrics struct {
+	traffic             connectionStats
+	connectionsAccepted atomic.Uint64
+	connectionsRejected atomic.Uint64
+	handshakesFailed    atomic.Uint64
+	encodeErrors        atomic.Uint64
+	decodeErrors        atomic.Uint64
+	decryptErrors       atomic.Uint64
+	handshakeLatency    latencyHistogram
+}
+
+// Publish a function's result as an expvar variable
+func publishExpvar(name string, stats func() any) error {
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("expvar %q is already published", name)
+	}
+
+	expvar.Publish(name, expvar.Func(stats))
+	return nil
+}
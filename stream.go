@@ -0,0 +1,451 @@
+package godtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// The maximum amount of stream data sent in a single frame
+const streamChunkSize = 16 * 1024
+
+// The amount of unread data a stream will buffer before the sender must wait
+const streamWindowSize = 256 * 1024
+
+// The size of a stream window update
+const streamWindowUpdateSize = 4
+
+// The default maximum number of streams the other side of a connection can have open at once
+const defaultMaxStreams = 256
+
+// ErrTooManyStreams is the reason a connection is closed when the other side opens more streams than allowed
+var ErrTooManyStreams = errors.New("too many open streams")
+
+// The purpose of a stream, sent when it is opened
+type streamKind byte
+
+// Stream kind values
+const (
+	streamGeneric streamKind = iota
+	streamFile
+)
+
+// A mutex that hands ownership to waiters in the order they arrived, so that writers sharing a connection take turns
+type fairMutex chan struct{}
+
+// Create a new fair mutex
+func newFairMutex() fairMutex {
+	return make(fairMutex, 1)
+}
+
+// Lock the mutex
+func (mutex fairMutex) Lock() {
+	mutex <- struct{}{}
+}
+
+// Unlock the mutex
+func (mutex fairMutex) Unlock() {
+	<-mutex
+}
+
+// Stream defines a logical stream multiplexed over a connection. Streams are opened by either side, and each side can
+// write until it closes the stream, after which the other side reads io.EOF once it has read all sent data.
+type Stream struct {
+	id          uint64
+	kind        streamKind
+	counted     bool
+	mux         *streamMux
+	mutex       sync.Mutex
+	cond        *sync.Cond
+	buffer      bytes.Buffer
+	unacked     int
+	sendWindow  int
+	readClosed  bool
+	writeClosed bool
+	err         error
+	failed      func(err error)
+}
+
+// ID returns the stream's ID, which is unique within its connection
+func (stream *Stream) ID() uint64 {
+	return stream.id
+}
+
+// Read data sent by the other side of the stream
+func (stream *Stream) Read(p []byte) (int, error) {
+	stream.mutex.Lock()
+
+	for stream.buffer.Len() == 0 && !stream.readClosed && stream.err == nil {
+		stream.cond.Wait()
+	}
+
+	if stream.buffer.Len() == 0 {
+		err := stream.err
+		if stream.readClosed {
+			err = io.EOF
+		}
+		stream.mutex.Unlock()
+		if err == io.EOF {
+			stream.mux.drain(stream)
+		}
+		return 0, err
+	}
+
+	n, _ := stream.buffer.Read(p)
+	stream.unacked += n
+	increment := 0
+	if stream.unacked >= streamWindowSize/2 {
+		increment = stream.unacked
+		stream.unacked = 0
+	}
+	stream.mutex.Unlock()
+
+	if increment > 0 {
+		update := make([]byte, streamWindowUpdateSize)
+		binary.BigEndian.PutUint32(update, uint32(increment))
+		// Ignore send error, since it will also surface on the connection
+		stream.mux.send(frameHeader{kind: frameStreamWindow, id: stream.id}, update)
+	}
+
+	return n, nil
+}
+
+// Write data to the other side of the stream, blocking while the other side has too much unread data
+func (stream *Stream) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		stream.mutex.Lock()
+
+		for stream.sendWindow == 0 && !stream.writeClosed && stream.err == nil {
+			stream.cond.Wait()
+		}
+
+		if stream.writeClosed {
+			stream.mutex.Unlock()
+			return written, io.ErrClosedPipe
+		}
+
+		if stream.err != nil {
+			err := stream.err
+			stream.mutex.Unlock()
+			return written, err
+		}
+
+		n := min(len(p), stream.sendWindow, streamChunkSize)
+		stream.sendWindow -= n
+		stream.mutex.Unlock()
+
+		err := stream.mux.send(frameHeader{kind: frameStreamData, id: stream.id}, p[:n])
+		if err != nil {
+			return written, err
+		}
+
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Close the stream for writing. The stream can still be read until the other side closes it.
+func (stream *Stream) Close() error {
+	stream.mutex.Lock()
+	if stream.writeClosed {
+		stream.mutex.Unlock()
+		return nil
+	}
+	stream.writeClosed = true
+	stream.cond.Broadcast()
+	err := stream.err
+	stream.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	err = stream.mux.send(frameHeader{kind: frameStreamClose, id: stream.id}, []byte{})
+	stream.mux.release(stream)
+	return err
+}
+
+// Receive data from the other side of the stream
+func (stream *Stream) receive(data []byte) error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	if stream.readClosed {
+		return fmt.Errorf("stream data received after close")
+	}
+
+	if stream.buffer.Len()+len(data) > streamWindowSize {
+		return fmt.Errorf("stream window exceeded")
+	}
+
+	stream.buffer.Write(data)
+	stream.cond.Broadcast()
+
+	return nil
+}
+
+// Allow more data to be written to the other side of the stream
+func (stream *Stream) grant(increment int) {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	stream.sendWindow += increment
+	stream.cond.Broadcast()
+}
+
+// Mark the other side of the stream as closed
+func (stream *Stream) closeRead() {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	stream.readClosed = true
+	stream.cond.Broadcast()
+}
+
+// Fail the stream, waking any blocked readers and writers
+func (stream *Stream) fail(err error) {
+	stream.mutex.Lock()
+	var failed func(err error)
+	if stream.err == nil {
+		stream.err = err
+		failed = stream.failed
+	}
+	stream.cond.Broadcast()
+	stream.mutex.Unlock()
+
+	if failed != nil {
+		failed(err)
+	}
+}
+
+// Call a function once the stream fails, or straight away if it already has
+func (stream *Stream) onFail(failed func(err error)) {
+	stream.mutex.Lock()
+	err := stream.err
+	if err == nil {
+		stream.failed = failed
+	}
+	stream.mutex.Unlock()
+
+	if err != nil {
+		failed(err)
+	}
+}
+
+// Check whether the other side has closed the stream and all data it sent has been read
+func (stream *Stream) drained() bool {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	return stream.readClosed && stream.buffer.Len() == 0
+}
+
+// Check whether both sides of the stream are closed
+func (stream *Stream) done() bool {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	return (stream.readClosed && stream.writeClosed) || stream.err != nil
+}
+
+// The streams multiplexed over a single connection
+type streamMux struct {
+	send          func(header frameHeader, data []byte) error
+	accept        func(stream *Stream)
+	mutex         sync.Mutex
+	streams       map[uint64]*Stream
+	nextID        uint64
+	maxStreams    int
+	remoteStreams int
+	err           error
+}
+
+// Create a new stream multiplexer. Streams opened by the client have odd IDs, and streams opened by the server have
+// even IDs, so that both sides can open streams without coordinating. The other side can have at most maxStreams
+// streams open at once, if positive.
+func newStreamMux(isClient bool, maxStreams int, send func(header frameHeader, data []byte) error, accept func(stream *Stream)) *streamMux {
+	nextID := uint64(2)
+	if isClient {
+		nextID = 1
+	}
+
+	return &streamMux{
+		send:       send,
+		accept:     accept,
+		streams:    make(map[uint64]*Stream),
+		nextID:     nextID,
+		maxStreams: maxStreams,
+	}
+}
+
+// Create a stream with the given ID
+func (mux *streamMux) newStream(id uint64, kind streamKind) *Stream {
+	stream := &Stream{
+		id:         id,
+		kind:       kind,
+		mux:        mux,
+		sendWindow: streamWindowSize,
+	}
+	stream.cond = sync.NewCond(&stream.mutex)
+	mux.streams[id] = stream
+	return stream
+}
+
+// Open a new stream
+func (mux *streamMux) open(kind streamKind) (*Stream, error) {
+	mux.mutex.Lock()
+	if mux.err != nil {
+		mux.mutex.Unlock()
+		return nil, mux.err
+	}
+	stream := mux.newStream(mux.nextID, kind)
+	mux.nextID += 2
+	mux.mutex.Unlock()
+
+	err := mux.send(frameHeader{kind: frameStreamOpen, id: stream.id}, []byte{byte(kind)})
+	if err != nil {
+		stream.fail(err)
+		mux.release(stream)
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// Get a stream by ID
+func (mux *streamMux) get(id uint64) (*Stream, bool) {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+
+	stream, ok := mux.streams[id]
+	return stream, ok
+}
+
+// Forget a stream once both sides have closed it
+func (mux *streamMux) release(stream *Stream) {
+	if !stream.done() {
+		return
+	}
+
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+
+	if mux.streams[stream.id] != stream {
+		return
+	}
+
+	delete(mux.streams, stream.id)
+	mux.uncount(stream)
+}
+
+// Stop counting a stream toward the other side's limit once it has closed the stream and all its data has been read,
+// even if this side never closes the stream
+func (mux *streamMux) drain(stream *Stream) {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+
+	mux.uncount(stream)
+}
+
+// Stop counting a stream opened by the other side toward its limit. The mux mutex must be held.
+func (mux *streamMux) uncount(stream *Stream) {
+	if stream.counted {
+		stream.counted = false
+		mux.remoteStreams--
+	}
+}
+
+// Handle a stream frame from the other side of the connection
+func (mux *streamMux) handle(header frameHeader, data []byte) error {
+	if header.kind == frameStreamOpen {
+		mux.mutex.Lock()
+		_, exists := mux.streams[header.id]
+		if exists || header.id%2 == mux.nextID%2 || mux.err != nil {
+			mux.mutex.Unlock()
+			return fmt.Errorf("invalid stream ID")
+		}
+		if mux.maxStreams > 0 && mux.remoteStreams >= mux.maxStreams {
+			mux.mutex.Unlock()
+			return ErrTooManyStreams
+		}
+		kind := streamGeneric
+		if len(data) > 0 {
+			kind = streamKind(data[0])
+		}
+		stream := mux.newStream(header.id, kind)
+		stream.counted = true
+		mux.remoteStreams++
+		mux.mutex.Unlock()
+
+		mux.accept(stream)
+		return nil
+	}
+
+	stream, ok := mux.get(header.id)
+	if !ok {
+		// The stream may have been released locally
+		return nil
+	}
+
+	switch header.kind {
+	case frameStreamData:
+		err := stream.receive(data)
+		if err != nil {
+			stream.fail(err)
+			mux.release(stream)
+			return err
+		}
+	case frameStreamWindow:
+		if len(data) != streamWindowUpdateSize {
+			return fmt.Errorf("invalid stream window update")
+		}
+		stream.grant(int(binary.BigEndian.Uint32(data)))
+	case frameStreamClose:
+		stream.closeRead()
+		if stream.drained() {
+			mux.drain(stream)
+		}
+		mux.release(stream)
+	}
+
+	return nil
+}
+
+// Fail all streams after the connection has closed
+func (mux *streamMux) close(err error) {
+	mux.mutex.Lock()
+	mux.err = err
+	streams := mux.streams
+	mux.streams = make(map[uint64]*Stream)
+	mux.remoteStreams = 0
+	mux.mutex.Unlock()
+
+	for _, stream := range streams {
+		stream.fail(err)
+	}
+}
+
+// Copy everything from a reader to a stream, then close the stream
+func copyToStream(stream *Stream, reader io.Reader) error {
+	buffer := make([]byte, streamChunkSize)
+	_, err := io.CopyBuffer(stream, reader, buffer)
+	if err != nil {
+		// Ignore close error, since the copy error is more relevant
+		stream.Close()
+		return err
+	}
+
+	return stream.Close()
+}
+
+// Check whether a frame kind belongs to a stream
+func isStreamFrame(kind frameKind) bool {
+	return kind >= frameStreamOpen && kind <= frameStreamClose
+}
@@ -0,0 +1,492 @@
+package godtp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The suffix of a file that is still being received
+const partialFileSuffix = ".part"
+
+// The number of bytes transferred between progress events
+const fileProgressInterval = 1024 * 1024
+
+// The size of the buffer used to copy file data
+const fileBufferSize = 32 * 1024
+
+// The maximum size of a file transfer control message
+const maxTransferMessageSize = 64 * 1024
+
+// ErrFileRejected is returned when the receiver of a file transfer rejects it
+var ErrFileRejected = errors.New("file transfer rejected")
+
+// The events a file transfer can report
+type fileEvent uint
+
+// File event values
+const (
+	fileOffered fileEvent = iota
+	fileProgress
+	fileComplete
+)
+
+// Hooks used by file transfers to report events and run work in the background
+type transferHooks struct {
+	emit  func(event fileEvent, transfer *FileTransfer)
+	spawn func(f func())
+}
+
+// The sender's description of a file
+type fileOffer struct {
+	ID   string
+	Name string
+	Size int64
+	Hash string
+}
+
+// The receiver's answer to a file offer
+type fileAnswer struct {
+	Accepted bool
+	Offset   int64
+	Reason   string
+}
+
+// The receiver's verdict once a file has been received
+type fileResult struct {
+	Error string
+}
+
+// FileTransfer defines a file being sent or received. The same file offered again, for example after reconnecting,
+// has the same ID, and accepting it to the same path resumes from the data already received.
+type FileTransfer struct {
+	ID          string
+	Name        string
+	Size        int64
+	Hash        string
+	Incoming    bool
+	stream      *Stream
+	hooks       transferHooks
+	mutex       sync.Mutex
+	offset      int64
+	transferred int64
+	answered    bool
+	done        chan struct{}
+	err         error
+}
+
+// Progress returns the number of bytes of the file transferred so far, including any resumed data, and the size of the
+// file
+func (transfer *FileTransfer) Progress() (int64, int64) {
+	transfer.mutex.Lock()
+	defer transfer.mutex.Unlock()
+
+	return transfer.transferred, transfer.Size
+}
+
+// Offset returns the offset the transfer resumed from
+func (transfer *FileTransfer) Offset() int64 {
+	transfer.mutex.Lock()
+	defer transfer.mutex.Unlock()
+
+	return transfer.offset
+}
+
+// Wait for the transfer to complete, returning the reason it failed, if any
+func (transfer *FileTransfer) Wait() error {
+	<-transfer.done
+	return transfer.err
+}
+
+// Err returns the reason the transfer failed, or nil if it succeeded or has not yet completed
+func (transfer *FileTransfer) Err() error {
+	select {
+	case <-transfer.done:
+		return transfer.err
+	default:
+		return nil
+	}
+}
+
+// Accept an offered file, saving it to a path. Data is written to the path with a ".part" suffix until the file is
+// received and its SHA-256 hash verified, and if that partial file already exists the transfer resumes from its end.
+// The transfer runs in the background.
+func (transfer *FileTransfer) Accept(path string) error {
+	err := transfer.answer()
+	if err != nil {
+		return err
+	}
+
+	partialPath := path + partialFileSuffix
+	file, err := os.OpenFile(partialPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		transfer.reject(err.Error())
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		transfer.reject(err.Error())
+		return err
+	}
+
+	offset := info.Size()
+	if offset > transfer.Size {
+		offset = 0
+		err = file.Truncate(0)
+		if err != nil {
+			file.Close()
+			transfer.reject(err.Error())
+			return err
+		}
+	}
+
+	fileHash := sha256.New()
+	_, err = io.CopyN(fileHash, file, offset)
+	if err != nil {
+		file.Close()
+		transfer.reject(err.Error())
+		return err
+	}
+
+	err = writeTransferMessage(transfer.stream, fileAnswer{
+		Accepted: true,
+		Offset:   offset,
+	})
+	if err != nil {
+		file.Close()
+		transfer.finish(err)
+		return err
+	}
+
+	transfer.mutex.Lock()
+	transfer.offset = offset
+	transfer.transferred = offset
+	transfer.mutex.Unlock()
+
+	transfer.hooks.spawn(func() {
+		transfer.receive(file, fileHash, path)
+	})
+
+	return nil
+}
+
+// Reject an offered file
+func (transfer *FileTransfer) Reject(reason string) error {
+	err := transfer.answer()
+	if err != nil {
+		return err
+	}
+
+	return transfer.reject(reason)
+}
+
+// Mark the offer as answered, failing if it already was
+func (transfer *FileTransfer) answer() error {
+	transfer.mutex.Lock()
+	defer transfer.mutex.Unlock()
+
+	if !transfer.Incoming {
+		return fmt.Errorf("only incoming file transfers can be answered")
+	}
+
+	if transfer.answered {
+		return fmt.Errorf("file transfer has already been answered")
+	}
+
+	transfer.answered = true
+	return nil
+}
+
+// Tell the sender the file was rejected and end the transfer
+func (transfer *FileTransfer) reject(reason string) error {
+	err := writeTransferMessage(transfer.stream, fileAnswer{
+		Reason: reason,
+	})
+	if err == nil {
+		err = transfer.stream.Close()
+	}
+
+	transfer.finish(fmt.Errorf("%w: %s", ErrFileRejected, reason))
+	return err
+}
+
+// Receive the remainder of an accepted file
+func (transfer *FileTransfer) receive(file *os.File, fileHash hash.Hash, path string) {
+	writer := io.MultiWriter(file, fileHash)
+	err := transfer.copy(writer, transfer.stream, transfer.Size-transfer.offset)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		// Keep the partial file so the transfer can be resumed
+		transfer.stream.Close()
+		transfer.finish(err)
+		return
+	}
+
+	partialPath := path + partialFileSuffix
+	if hex.EncodeToString(fileHash.Sum(nil)) != transfer.Hash {
+		err = fmt.Errorf("file hash mismatch")
+		os.Remove(partialPath)
+	} else {
+		err = os.Rename(partialPath, path)
+	}
+
+	result := fileResult{}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	sendErr := writeTransferMessage(transfer.stream, result)
+	if sendErr == nil {
+		sendErr = transfer.stream.Close()
+	}
+	if err == nil {
+		err = sendErr
+	}
+
+	transfer.finish(err)
+}
+
+// Send an offered file once the receiver answers
+func (transfer *FileTransfer) send(file *os.File) {
+	defer file.Close()
+
+	answer := fileAnswer{}
+	err := readTransferMessage(transfer.stream, &answer)
+	if err != nil {
+		transfer.stream.Close()
+		transfer.finish(err)
+		return
+	}
+
+	if !answer.Accepted {
+		transfer.stream.Close()
+		transfer.finish(fmt.Errorf("%w: %s", ErrFileRejected, answer.Reason))
+		return
+	}
+
+	if answer.Offset < 0 || answer.Offset > transfer.Size {
+		transfer.stream.Close()
+		transfer.finish(fmt.Errorf("invalid file transfer offset"))
+		return
+	}
+
+	transfer.mutex.Lock()
+	transfer.offset = answer.Offset
+	transfer.transferred = answer.Offset
+	transfer.mutex.Unlock()
+
+	_, err = file.Seek(answer.Offset, io.SeekStart)
+	if err == nil {
+		err = transfer.copy(transfer.stream, file, transfer.Size-answer.Offset)
+	}
+	closeErr := transfer.stream.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		transfer.finish(err)
+		return
+	}
+
+	result := fileResult{}
+	err = readTransferMessage(transfer.stream, &result)
+	if err == nil && result.Error != "" {
+		err = fmt.Errorf("file transfer failed: %s", result.Error)
+	}
+
+	transfer.finish(err)
+}
+
+// Copy file data, reporting progress along the way
+func (transfer *FileTransfer) copy(writer io.Writer, reader io.Reader, size int64) error {
+	buffer := make([]byte, fileBufferSize)
+	remaining := size
+	sinceProgress := int64(0)
+
+	for remaining > 0 {
+		n, err := io.ReadFull(reader, buffer[:min(int64(len(buffer)), remaining)])
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		_, err = writer.Write(buffer[:n])
+		if err != nil {
+			return err
+		}
+
+		remaining -= int64(n)
+		sinceProgress += int64(n)
+
+		transfer.mutex.Lock()
+		transfer.transferred += int64(n)
+		transfer.mutex.Unlock()
+
+		if sinceProgress >= fileProgressInterval || remaining == 0 {
+			sinceProgress = 0
+			transfer.hooks.emit(fileProgress, transfer)
+		}
+	}
+
+	return nil
+}
+
+// Complete the transfer. The completion event is emitted in the background, since the transfer may be finished by
+// Accept or Reject on the goroutine that handles events.
+func (transfer *FileTransfer) finish(err error) {
+	transfer.err = err
+	close(transfer.done)
+	transfer.hooks.spawn(func() {
+		transfer.hooks.emit(fileComplete, transfer)
+	})
+}
+
+// End an offer that was never answered because its stream failed, such as when the connection closed
+func (transfer *FileTransfer) abandon(err error) {
+	transfer.mutex.Lock()
+	if transfer.answered {
+		transfer.mutex.Unlock()
+		return
+	}
+	transfer.answered = true
+	transfer.mutex.Unlock()
+
+	transfer.finish(err)
+}
+
+// Offer a file over a stream, sending it in the background once the receiver answers
+func sendFile(stream *Stream, path string, hooks transferHooks) (*FileTransfer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	fileHash := sha256.New()
+	size, err := io.Copy(fileHash, file)
+	if err != nil {
+		file.Close()
+		stream.Close()
+		return nil, err
+	}
+
+	offer := fileOffer{
+		Name: filepath.Base(path),
+		Size: size,
+		Hash: hex.EncodeToString(fileHash.Sum(nil)),
+	}
+	offer.ID = transferID(offer)
+
+	err = writeTransferMessage(stream, offer)
+	if err != nil {
+		file.Close()
+		stream.Close()
+		return nil, err
+	}
+
+	transfer := newFileTransfer(offer, false, stream, hooks)
+	hooks.spawn(func() {
+		transfer.send(file)
+	})
+
+	return transfer, nil
+}
+
+// Read a file offer from a stream and report it
+func receiveFileOffer(stream *Stream, hooks transferHooks) {
+	offer := fileOffer{}
+	err := readTransferMessage(stream, &offer)
+	if err != nil || offer.Size < 0 || offer.ID != transferID(offer) {
+		stream.Close()
+		return
+	}
+
+	if !validFileName(offer.Name) {
+		// Ignore write error, since the offer is refused either way
+		writeTransferMessage(stream, fileAnswer{Reason: "invalid file name"})
+		stream.Close()
+		return
+	}
+
+	transfer := newFileTransfer(offer, true, stream, hooks)
+	stream.onFail(transfer.abandon)
+	hooks.emit(fileOffered, transfer)
+}
+
+// Check that an offered file name is a single path element, so it cannot refer to a file outside the directory it is
+// saved to
+func validFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && name == filepath.Base(name) && !strings.ContainsAny(name, `/\`)
+}
+
+// Create a new file transfer
+func newFileTransfer(offer fileOffer, incoming bool, stream *Stream, hooks transferHooks) *FileTransfer {
+	return &FileTransfer{
+		ID:       offer.ID,
+		Name:     offer.Name,
+		Size:     offer.Size,
+		Hash:     offer.Hash,
+		Incoming: incoming,
+		stream:   stream,
+		hooks:    hooks,
+		done:     make(chan struct{}),
+	}
+}
+
+// Get the ID of a file transfer, derived from the file's name, size and hash
+func transferID(offer fileOffer) string {
+	id := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%s", offer.Name, offer.Size, offer.Hash)))
+	return hex.EncodeToString(id[:16])
+}
+
+// Write a file transfer control message to a stream
+func writeTransferMessage(stream *Stream, message any) error {
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	_, err = stream.Write(encodeMessage(messageBytes))
+	return err
+}
+
+// Read a file transfer control message from a stream
+func readTransferMessage(stream *Stream, message any) error {
+	sizeBuffer := make([]byte, lenSize)
+	_, err := io.ReadFull(stream, sizeBuffer)
+	if err != nil {
+		return err
+	}
+
+	msgSize := decodeMessageSize(sizeBuffer)
+	if msgSize > maxTransferMessageSize {
+		return fmt.Errorf("file transfer message too large")
+	}
+
+	buffer := make([]byte, msgSize)
+	_, err = io.ReadFull(stream, buffer)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(buffer, message)
+}
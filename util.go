@@ -2,7 +2,10 @@ package godtp
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"strconv"
 	"strings"
 )
@@ -10,6 +13,15 @@ import (
 // The length of the size portion of a message
 const lenSize = 5
 
+// The default maximum size of a message, after encryption or decompression. Larger data should be sent over a stream.
+const defaultMaxMessageSize = 64 << 20
+
+// The maximum size of a key exchange message
+const maxHandshakeSize = 64 << 10
+
+// ErrMessageTooLarge is returned when a message exceeds the maximum message size
+var ErrMessageTooLarge = errors.New("message too large")
+
 // The buffer size of each channel
 const channelBufferSize = 100
 
@@ -49,6 +61,57 @@ func decodeMessageSize(encodedSize []byte) uint64 {
 	return size
 }
 
+// Prefix a message with its size
+func encodeMessage(message []byte) []byte {
+	buffer := make([]byte, lenSize, lenSize+len(message))
+	copy(buffer, encodeMessageSize(uint64(len(message))))
+	return append(buffer, message...)
+}
+
+// Read a size-prefixed message of at most the given maximum message size, or of any size if it is 0
+func readMessage(reader io.Reader, maxSize int) ([]byte, error) {
+	limit := uint64(math.MaxUint64)
+	if maxSize > 0 {
+		limit = uint64(maxSize)
+	}
+
+	return readMessageLimit(reader, limit)
+}
+
+// Check a message against a maximum message size, where 0 allows any size
+func checkMessageSize(message []byte, maxSize int) error {
+	if maxSize > 0 && len(message) > maxSize {
+		return fmt.Errorf("%w: %d > %d bytes", ErrMessageTooLarge, len(message), maxSize)
+	}
+
+	return nil
+}
+
+// Read a size-prefixed message of at most the given size. The buffer grows as data arrives, so a peer cannot force a
+// large allocation by claiming a large size.
+func readMessageLimit(reader io.Reader, limit uint64) ([]byte, error) {
+	sizeBuffer := make([]byte, lenSize)
+	_, err := io.ReadFull(reader, sizeBuffer)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	msgSize := decodeMessageSize(sizeBuffer)
+	if msgSize > limit {
+		return []byte{}, fmt.Errorf("%w: %d > %d bytes", ErrMessageTooLarge, msgSize, limit)
+	}
+
+	buffer, err := io.ReadAll(io.LimitReader(reader, int64(msgSize)))
+	if err != nil {
+		return []byte{}, err
+	}
+	if uint64(len(buffer)) < msgSize {
+		return []byte{}, io.ErrUnexpectedEOF
+	}
+
+	return buffer, nil
+}
+
 // Parse an address
 func parseAddr(addr string) (string, uint16, error) {
 	index := strings.LastIndex(addr, ":")
@@ -0,0 +1,52 @@
+package godtp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidMessage is reported when a received message cannot be decoded or fails validation
+var ErrInvalidMessage = errors.New("invalid message")
+
+// ValidationPolicy defines what happens when a peer sends an invalid message
+type ValidationPolicy uint8
+
+// Validation policy values
+const (
+	// ValidationDisconnect reports the invalid message and disconnects the peer
+	ValidationDisconnect ValidationPolicy = iota
+	// ValidationSkip reports the invalid message and drops it, keeping the connection open
+	ValidationSkip
+)
+
+// Validator defines a message type that can check its own contents. Received messages of types implementing Validator
+// are validated before they are emitted.
+type Validator interface {
+	Validate() error
+}
+
+// Decode message data and validate it, first with its own Validate method, if it has one, and then with the given
+// validation function, if any
+func decodeValidData[T any](byteString []byte, codec Codec, registry *Registry, validate func(data T) error) (T, error) {
+	data, err := decodeData[T](byteString, codec, registry)
+	if errors.Is(err, ErrUnknownMessageType) {
+		return data, err
+	}
+	if err != nil {
+		return data, fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+	}
+
+	if validator, ok := any(data).(Validator); ok {
+		err = validator.Validate()
+	} else if validator, ok := any(&data).(Validator); ok {
+		err = validator.Validate()
+	}
+	if err == nil && validate != nil {
+		err = validate(data)
+	}
+	if err != nil {
+		return data, fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+	}
+
+	return data, nil
+}